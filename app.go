@@ -3,8 +3,13 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"os"
@@ -20,9 +25,13 @@ const (
 
 	CONF_TIME_LAYOUT = "15:04"
 
-	API_TRY_CNT         = 5
-	API_WAIT_SEC        = 3
 	API_TOKEN_HEADER_ID = "api-token"
+	IDEMPOTENCY_HEADER  = "Idempotency-Key"
+	API_DRAIN_MAX       = 64 * 1024 // response body read before close to reuse connection
+
+	DEF_MAX_LOOK_BACK_DAYS = 90 // API last sale date limit
+
+	SHUTDOWN_TIMEOUT_SEC = 30 // time for the request in progress to complete on shutdown
 )
 
 type App struct {
@@ -31,11 +40,41 @@ type App struct {
 	WebServer *http.Server
 
 	webServerCred string
-	sqlFilter     string
+	sqlFilter     string        // filter condition with named parameters
+	sqlFilterArgs []interface{} // sql.NamedArg values for sqlFilter
+	queryTemplate *QueryTemplate
+	location      *time.Location // RKeeper time zone
+	schedule      *Schedule
+	checkpoints   *CheckpointStore
+	outbox        *OutboxStore // undelivered batches, not used if nil
+	db            *sql.DB      // MS SQL connection pool
+	httpClient    *http.Client // API client
+
+	destinations []*destination // several APIs fed by one read, not used if empty
+	lookupIDs    idLookup       // LookupIDs() by default, resolves destination filters
+	routeGroups  []*routeGroup  // location routing, nil if locations are not set
+
+	pageSize    int             // rows per page
+	batchPeriod [2]time.Time    // export period of the batches being sent, part of idempotency key
+	pageSizes   []int           // page sizes chosen during the run
+	deadLetters deadLetterStats // checks rejected during the run
+	fetchPage   pageFetcher     // FetchRKData() by default
+	queryRows   rowQuery        // QueryRows() by default, used by streaming export
 }
 
+// pageFetcher returns a page of data with check keys.
+type pageFetcher func(ctx context.Context, from, count int, after CheckKey, dateFrom, dateTo time.Time) ([]RKRow, []CheckKey, error)
+
+// rowQuery calls fn for every row of a page with its check key.
+type rowQuery func(ctx context.Context, from, count int, after CheckKey, dateFrom, dateTo time.Time, fn func(row RKRow, key CheckKey) error) error
+
 func NewApp() *App {
-	return &App{Config: &AppConfig{}}
+	a := &App{Config: &AppConfig{}, pageSize: DEF_PARAM_COUNT, location: time.Local}
+	a.httpClient, _ = newHTTPClient(HTTPClient{}) //defaults never fail
+	a.fetchPage = a.FetchRKData
+	a.queryRows = a.QueryRows
+	a.lookupIDs = a.LookupIDs
+	return a
 }
 
 func (a *App) LoadConfig(configData []byte) error {
@@ -48,8 +87,66 @@ func (a *App) LoadConfig(configData []byte) error {
 		return err
 	}
 
+	//RKeeper datetimes are local time without zone
+	if a.Config.Timezone == "" {
+		a.location = time.Local
+	} else {
+		loc, err := time.LoadLocation(a.Config.Timezone)
+		if err != nil {
+			return fmt.Errorf("time.LoadLocation() failed: %v", err)
+		}
+		a.location = loc
+	}
+
+	if err := a.Config.Retry.setDefaults(); err != nil {
+		return err
+	}
+	if err := a.Config.Batch.setDefaults(); err != nil {
+		return err
+	}
+	//streamed requests are not parked, rows are read again on the next cycle
+	if a.Config.Stream.Enabled && a.Config.Outbox != (Outbox{}) {
+		return fmt.Errorf("outbox is not supported with stream")
+	}
+	a.pageSize = a.Config.Batch.Size
+	http_client, err := newHTTPClient(a.Config.HTTPClient)
+	if err != nil {
+		return err
+	}
+	a.httpClient = http_client
+
+	if err := a.Config.setFormatDefaults(); err != nil {
+		return err
+	}
+	if err := a.Config.validateURLs(); err != nil {
+		return err
+	}
+
+	act_times := a.Config.ActivationTimes
+	if a.Config.ActivationTime != "" {
+		act_times = append([]string{a.Config.ActivationTime}, act_times...)
+	}
+	schedule, err := ParseSchedule(act_times, a.Config.ActivationInterval, a.Config.ActivationCron)
+	if err != nil {
+		return err
+	}
+	a.schedule = schedule
+
 	//build sql filter string
 	a.SetSQLFilter()
+	if err := a.initDestinations(); err != nil {
+		return err
+	}
+
+	//query template is read once and reloaded on change
+	query_file, err := QueryFileName(a.Config.QueryFile)
+	if err != nil {
+		return err
+	}
+	if a.queryTemplate, err = LoadQueryTemplate(query_file); err != nil {
+		return err
+	}
+	a.Log.Infof("query template: %s", query_file)
 
 	return nil
 }
@@ -101,17 +198,12 @@ func (a *App) initLogger() error {
 	return nil
 }
 
-func (a *App) NextActDate(now time.Time, actTime string) (time.Time, error) {
-	act_time, err := time.Parse(CONF_TIME_LAYOUT, actTime)
-	if err != nil {
-		return time.Time{}, err
+// NextActDate returns the next activation after now by the schedule from configuration.
+func (a *App) NextActDate(now time.Time) (time.Time, error) {
+	if a.schedule == nil {
+		return time.Time{}, fmt.Errorf("activation schedule is not set")
 	}
-	act_dt := time.Date(now.Year(), now.Month(), now.Day(), act_time.Hour(), act_time.Minute(), 0, 0, now.Location())
-	if now.Hour()*60+now.Minute() >= act_time.Hour()*60+act_time.Minute() {
-		act_dt = act_dt.Add(24 * time.Hour)
-	}
-	// fmt.Println("actTime:", actTime, "act_dt:", act_dt)
-	return act_dt, nil
+	return a.schedule.Next(now)
 }
 
 type ReportPeriodDate time.Time
@@ -133,12 +225,16 @@ func (d *ReportPeriodDate) UnmarshalJSON(data []byte) error {
 }
 
 type LastSaleDateResponse struct {
+	Success      *bool            `json:"success"` // false if API failed, the field may be omitted
 	LastSaleDate ReportPeriodDate `json:"last_sale_date"`
 }
 
 // FetchReportPerod retirieves dateFrom and dateTo paramerers from url.
-// It tries http query API_TRY_CNT times with a pause of API_WAIT_SEC.
-func (a *App) FetchReportPerod(url string, apiKey string) (time.Time, time.Time, error) {
+// Failed requests are retried by the retry policy from configuration.
+// Responses with status other than 2xx, success=false or without last_sale_date
+// are errors. dateFrom is not earlier than maxLookBackDays before today.
+// The request and the pauses are interrupted when ctx is done.
+func (a *App) FetchReportPerod(ctx context.Context, url string, apiKey string) (time.Time, time.Time, error) {
 	// d1, err := time.Parse(ReportPeriodLoyout, "2024-07-01")
 	// if err != nil {
 	// 	return time.Time{}, time.Time{}, err
@@ -148,149 +244,378 @@ func (a *App) FetchReportPerod(url string, apiKey string) (time.Time, time.Time,
 	// 	return time.Time{}, time.Time{}, err
 	// }
 	// return d1, d2, nil
-	tries_for_query := API_TRY_CNT
-	for tries_for_query > 0 {
-		client := &http.Client{}
-		req, err := http.NewRequest("GET", url, nil)
+	date_resp := LastSaleDateResponse{}
+	if err := a.retry(ctx, "FetchReportPerod()", func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 		if err != nil {
-			a.Log.Errorf("http.NewRequest() failed: %v", err)
-			time.Sleep(time.Duration(API_WAIT_SEC) * time.Second)
-			tries_for_query--
-			continue
+			return permanent(fmt.Errorf("http.NewRequest() failed: %v", err))
 		}
 
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set(API_TOKEN_HEADER_ID, apiKey) //add API key
 
-		resp, err := client.Do(req)
+		resp, err := a.httpClient.Do(req)
 		if err != nil {
-			a.Log.Errorf("http.Do() failed: %v", err)
-			time.Sleep(time.Duration(API_WAIT_SEC) * time.Second)
-			tries_for_query--
-			continue
+			return fmt.Errorf("http.Do() failed: %v", err)
+		}
+		defer drainClose(resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return newAPIError(resp)
 		}
 
-		defer resp.Body.Close()
 		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			a.Log.Errorf("io.ReadAll() failed: %v", err)
-			time.Sleep(time.Duration(API_WAIT_SEC) * time.Second)
-			tries_for_query--
-			continue
+			return fmt.Errorf("io.ReadAll() failed: %v", err)
 		}
-
-		date_resp := LastSaleDateResponse{}
 		if err := json.Unmarshal(body, &date_resp); err != nil {
-			a.Log.Errorf("json.Unmarshal() failed to unmarshal last sale date: %v", err)
-			time.Sleep(time.Duration(API_WAIT_SEC) * time.Second)
-			tries_for_query--
+			return permanent(fmt.Errorf("json.Unmarshal() failed to unmarshal last sale date: %v, body: %s", err, apiErrorBody(body)))
+		}
+		if date_resp.Success != nil && !*date_resp.Success {
+			return permanent(fmt.Errorf("API last sale date request failed: %s", apiErrorBody(body)))
+		}
+		if time.Time(date_resp.LastSaleDate).IsZero() {
+			return permanent(fmt.Errorf("API last sale date is not set: %s", apiErrorBody(body)))
+		}
+		return nil
+	}); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	//set toDate to end of day
+	last_sale_date := time.Time(date_resp.LastSaleDate)
+	dt_from := time.Date(last_sale_date.Year(), last_sale_date.Month(), last_sale_date.Day(), 0, 0, 0, 0, a.location)
+	now := a.now()
+	dt_to := endOfDay(now)
+	if dt_from.After(dt_to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("API last sale date %s is in the future", dt_from.Format(ReportPeriodLoyout))
+	}
+
+	//older data can be sent with backfill
+	look_back := defInt(a.Config.MaxLookBackDays, DEF_MAX_LOOK_BACK_DAYS)
+	min_dt := time.Date(now.Year(), now.Month(), now.Day()-look_back, 0, 0, 0, 0, a.location)
+	if dt_from.Before(min_dt) {
+		a.Log.Warnf("API last sale date %s is more than %d days ago, period starts from %s, use backfill for older data",
+			dt_from.Format(ReportPeriodLoyout), look_back, min_dt.Format(ReportPeriodLoyout))
+		dt_from = min_dt
+	}
+
+	return dt_from, dt_to, nil
+}
+
+// now returns current time in RKeeper time zone.
+func (a *App) now() time.Time {
+	return time.Now().In(a.location)
+}
+
+// sleepContext pauses for d, it returns ctx error if ctx is done earlier.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// requestContext returns context for a request which should not be cut in the middle:
+// when ctx is done, the request has SHUTDOWN_TIMEOUT_SEC more to complete.
+func requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	req_ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(time.Duration(SHUTDOWN_TIMEOUT_SEC)*time.Second, cancel)
+	})
+	return req_ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+func endOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 23, 59, 59, 999, t.Location())
+}
+
+// OpenCheckpoints loads checkpoint store from file.
+func (a *App) OpenCheckpoints(fileName string) error {
+	st, err := LoadCheckpointStore(fileName)
+	if err != nil {
+		return fmt.Errorf("LoadCheckpointStore() failed: %v", err)
+	}
+	a.checkpoints = st
+	return nil
+}
+
+// ReportPeriod returns export period. The lower bound is taken from
+// the checkpoint store, if there is no checkpoint yet, the period is
+// retrieved from API with FetchReportPerod().
+func (a *App) ReportPeriod(ctx context.Context, url string, apiKey string) (time.Time, time.Time, error) {
+	if a.checkpoints != nil {
+		if dt_from, ok := a.checkpoints.LowerBound(); ok {
+			a.Log.Debugf("period lower bound from checkpoint: %v", dt_from)
+			return dt_from, endOfDay(a.now()), nil
+		}
+	}
+	return a.FetchReportPerod(ctx, url, apiKey)
+}
+
+// filterDelivered removes rows which are not after checkpoints of their groups.
+func (a *App) filterDelivered(rkData []RKRow, keys []CheckKey) ([]RKRow, []CheckKey) {
+	if a.checkpoints == nil {
+		return rkData, keys
+	}
+	rk_data := make([]RKRow, 0, len(rkData))
+	rk_keys := make([]CheckKey, 0, len(keys))
+	for i := range rkData {
+		if a.checkpoints.Delivered(keys[i]) {
 			continue
 		}
-		//set toDate to end of day
-		dt_from := time.Time(date_resp.LastSaleDate)
-		n := time.Now()
-		dt_to := time.Date(n.Year(), n.Month(), n.Day(), 23, 59, 59, 999, n.Location())
+		rk_data = append(rk_data, rkData[i])
+		rk_keys = append(rk_keys, keys[i])
+	}
+	return rk_data, rk_keys
+}
 
-		return dt_from, dt_to, nil
+// commitCheckpoints moves checkpoints forward after a successful delivery.
+func (a *App) commitCheckpoints(keys []CheckKey) error {
+	if a.checkpoints == nil {
+		return nil
+	}
+	a.checkpoints.Update(keys)
+	return a.checkpoints.Save()
+}
+
+// DataEnvelope is the body of send data request.
+type DataEnvelope struct {
+	Schema         string  `json:"schema"`                    // check|raw
+	SchemaVersion  int     `json:"schema_version,omitempty"`  // CHECK_SCHEMA_VERSION for check schema
+	IdempotencyKey string  `json:"idempotency_key,omitempty"` // batchKey(), also sent in IDEMPOTENCY_HEADER
+	Data           []RKRow `json:"data"`
+}
+
+func (a *App) dataEnvelope(rkData []RKRow) *DataEnvelope {
+	env := &DataEnvelope{Schema: a.Config.Schema, Data: rkData}
+	if env.Schema == SCHEMA_CHECK {
+		env.SchemaVersion = CHECK_SCHEMA_VERSION
 	}
-	return time.Time{}, time.Time{}, fmt.Errorf("error fetching report period")
+	return env
+}
+
+// batchKey returns idempotency key of the batch: sha256 of scID, saleLocationID,
+// export period (batchPeriod dates) and check keys with close times, so the same checks
+// of the same period always give the same key and the receiver can drop a batch which was stored before.
+// Without keys or with rows without key (query without key columns) rkData is hashed.
+func (a *App) batchKey(rkData []RKRow, keys []CheckKey) (string, error) {
+	h := a.newBatchHash()
+	if len(keys) == 0 || keys[0].IsZero() {
+		if err := json.NewEncoder(h).Encode(rkData); err != nil {
+			return "", fmt.Errorf("json.Encode() failed: %v", err)
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	for _, key := range keys {
+		hashBatchKey(h, key)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newBatchHash starts batchKey() hash, check keys are added with hashBatchKey().
+func (a *App) newBatchHash() hash.Hash {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", a.Config.ScID, a.Config.SaleLocationID,
+		a.batchPeriod[0].Format(ReportPeriodLoyout), a.batchPeriod[1].Format(ReportPeriodLoyout))
+	return h
+}
+
+func hashBatchKey(h hash.Hash, key CheckKey) {
+	fmt.Fprintf(h, "%s@%s\n", key.ID(), key.CloseTime.UTC().Format(time.RFC3339Nano))
 }
 
 // SendData sends rk data to url.
-// rkData is marshaled with json.Marshal().
-// It tries http query API_TRY_CNT times with a pause of API_WAIT_SEC.
-func (a *App) SendData(rkData []RKDate, url string, apiKey string) error {
-	//marshal data
-	rk_data_b, err := json.Marshal(rkData)
+// rkData is marshaled with json.Marshal(), keys give the idempotency key.
+// Failed requests are retried by the retry policy from configuration.
+// When ctx is done, the request in progress is given SHUTDOWN_TIMEOUT_SEC
+// to complete, no more attempts are made.
+// A batch of several rows exceeding Batch.MaxBytes is not sent, errBatchTooLarge is returned.
+func (a *App) SendData(ctx context.Context, rkData []RKRow, keys []CheckKey, url string, apiKey string) error {
+	rk_data_b_wr, batch_key, err := a.encodeBatch(rkData, keys)
+	if err != nil {
+		return err
+	}
+	if max_bytes := a.Config.Batch.MaxBytes; max_bytes > 0 && len(rk_data_b_wr) > max_bytes && len(rkData) > 1 {
+		return fmt.Errorf("%w: %d bytes", errBatchTooLarge, len(rk_data_b_wr))
+	}
+	req, err := a.newDataRequest(rk_data_b_wr, batch_key, url, apiKey)
 	if err != nil {
 		return err
 	}
 
-	//wrapper
-	rk_data_b_wr := []byte(`{"data":`)
-	rk_data_b_wr = append(rk_data_b_wr, rk_data_b...)
-	rk_data_b_wr = append(rk_data_b_wr, []byte(`}`)...)
-
-	//send
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(rk_data_b_wr))
+	var resp_time time.Duration
+	err = a.retry(ctx, "SendData()", func() error {
+		start := time.Now()
+		err := a.doDataRequest(ctx, req)
+		var api_err *APIError
+		switch {
+		case errors.As(err, &api_err):
+			a.Log.Errorf("request url: %s, request body: %s", url, string(rk_data_b_wr))
+			return err
+		case err != nil && len(rkData) > 1 && a.batchTooLarge(err):
+			return permanent(err) //a smaller batch is sent instead
+		}
+		resp_time = time.Since(start)
+		return err
+	})
 	if err != nil {
 		return err
 	}
+	a.batchSent(len(rkData), len(rk_data_b_wr), resp_time)
+	return nil
+}
+
+// encodeBatch returns request body of the batch: data envelope with idempotency key.
+func (a *App) encodeBatch(rkData []RKRow, keys []CheckKey) ([]byte, string, error) {
+	env := a.dataEnvelope(rkData)
+	batch_key, err := a.batchKey(rkData, keys)
+	if err != nil {
+		return nil, "", err
+	}
+	env.IdempotencyKey = batch_key
+	body, err := json.Marshal(env)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, batch_key, nil
+}
+
+// newDataRequest returns send data request, the body is compressed if configured.
+func (a *App) newDataRequest(body []byte, batchKey, url, apiKey string) (*http.Request, error) {
+	var err error
+	if a.Config.HTTPClient.Gzip {
+		if body, err = gzipData(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
 
 	req.Header.Set("Content-Type", "application/json")
+	if a.Config.HTTPClient.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
 	req.Header.Set(API_TOKEN_HEADER_ID, apiKey) //add API key
+	req.Header.Set(IDEMPOTENCY_HEADER, batchKey)
+	return req, nil
+}
 
-	tries_for_query := API_TRY_CNT
-	for tries_for_query > 0 {
-		resp, err := client.Do(req)
-		if err != nil {
-			a.Log.Errorf("client.Do() failed: %v", err)
-			time.Sleep(time.Duration(API_WAIT_SEC) * time.Second)
-			tries_for_query--
-			continue
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				a.Log.Errorf("io.ReadAll() failed to read body: %v", err)
-				time.Sleep(time.Duration(API_WAIT_SEC) * time.Second)
-				tries_for_query--
-				continue
-			}
-			a.Log.Errorf("API send data response status code: %d, body: %s", resp.StatusCode, string(body))
-			a.Log.Errorf("request url: %s, request body: %s", url, string(rk_data_b_wr))
-			time.Sleep(time.Duration(API_WAIT_SEC) * time.Second)
-			tries_for_query--
-			continue
-		}
-		return nil
+// doDataRequest makes one attempt of send data request,
+// every attempt sends a fresh copy of the body.
+func (a *App) doDataRequest(ctx context.Context, req *http.Request) error {
+	req_ctx, cancel := requestContext(ctx)
+	defer cancel()
+
+	attempt_req := req.Clone(req_ctx)
+	body, err := req.GetBody()
+	if err != nil {
+		return permanent(fmt.Errorf("req.GetBody() failed: %v", err))
+	}
+	attempt_req.Body = body
+
+	resp, err := a.httpClient.Do(attempt_req)
+	if err != nil {
+		return fmt.Errorf("client.Do() failed: %w", err)
 	}
-	return fmt.Errorf("error sending data")
+	defer drainClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return newAPIError(resp)
+	}
+	return nil
+}
+
+// drainClose reads the rest of response body, so the connection
+// can be reused, and closes it.
+func drainClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, API_DRAIN_MAX))
+	body.Close()
 }
 
 func ensureSlash(url string) string {
-	url_l := len(url)
-	url_cor := url
-	if url[url_l-1:url_l] != "/" {
-		url_cor += "/"
+	if strings.HasSuffix(url, "/") {
+		return url
 	}
-	return url_cor
+	return url + "/"
 }
 
-// main loop
-func (a *App) Start() error {
+// APIUrls checks API configuration and returns
+// report period url and send data url. Period placeholders
+// of send data url are replaced by sendPeriod() with the dates of the period.
+func (a *App) APIUrls() (string, string, error) {
 	//checking
 	if a.Config.APIUrl == "" {
-		return fmt.Errorf("API url not set")
+		return "", "", fmt.Errorf("API url not set")
 	}
 	if a.Config.APIKey == "" {
-		return fmt.Errorf("APIKey not set")
+		return "", "", fmt.Errorf("APIKey not set")
 	}
 	if a.Config.ScID == "" {
-		return fmt.Errorf("scID not set")
+		return "", "", fmt.Errorf("scID not set")
 	}
 	if a.Config.SaleLocationID == "" {
-		return fmt.Errorf("saleLocationID not set")
+		return "", "", fmt.Errorf("saleLocationID not set")
 	}
 
-	url := ensureSlash(a.Config.APIUrl)
-	url = strings.ReplaceAll(url, "{{scID}}", a.Config.ScID)
-	url = strings.ReplaceAll(url, "{{saleLocationID}}", a.Config.SaleLocationID)
-
 	if a.Config.APICmdGetPeriod == "" {
-		return fmt.Errorf("API cmdGetPeriod not set")
+		return "", "", fmt.Errorf("API cmdGetPeriod not set")
 	}
-	cmd_period := ensureSlash(a.Config.APICmdGetPeriod)
-
 	if a.Config.APICmdPutData == "" {
-		return fmt.Errorf("API cmdPutPeriod not set")
+		return "", "", fmt.Errorf("API cmdPutPeriod not set")
+	}
+
+	values := map[string]string{
+		URL_PH_SC_ID:            a.Config.ScID,
+		URL_PH_SALE_LOCATION_ID: a.Config.SaleLocationID,
+	}
+	period_url, err := expandURL(joinURL(a.Config.APIUrl, a.Config.APICmdGetPeriod), values)
+	if err != nil {
+		return "", "", fmt.Errorf("expandURL() failed: %v", err)
+	}
+	data_url, err := expandURL(joinURL(a.Config.APIUrl, a.Config.APICmdPutData), values)
+	if err != nil {
+		return "", "", fmt.Errorf("expandURL() failed: %v", err)
+	}
+	if err := checkAbsURL(period_url); err != nil {
+		return "", "", err
+	}
+	return period_url, data_url, nil
+}
+
+// Start runs main loop till ctx is done. On shutdown the batch being sent
+// is given SHUTDOWN_TIMEOUT_SEC to complete, no new pages are fetched,
+// the data left undelivered is sent on the next run.
+// With destinations every cycle is sendDestinations(), a failure of some
+// destinations does not stop the others.
+func (a *App) Start(ctx context.Context) error {
+	var rep_period_url, send_data_url string
+	var err error
+	if len(a.destinations) > 0 {
+		err = a.destinationURLs()
+	} else {
+		rep_period_url, send_data_url, err = a.APIUrls()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := a.OpenDB(ctx); err != nil {
+		return err
+	}
+	defer a.CloseDB()
+
+	if a.schedule == nil || a.schedule.Empty() {
+		return fmt.Errorf("activation schedule is not set: activationTime, activationTimes, activationInterval or activationCron is required")
 	}
-	cmd_data := ensureSlash(a.Config.APICmdPutData)
 
-	rep_period_url := fmt.Sprintf("%s%s", url, cmd_period)
-	send_data_url := fmt.Sprintf("%s%s", url, cmd_data)
 	a.Log.Debugf("get date url: %s", rep_period_url)
 	a.Log.Debugf("put data url: %s", send_data_url)
 	first_query := true
@@ -298,98 +623,324 @@ func (a *App) Start() error {
 	//main wait loop. On first start send query anyway.
 	for {
 		if !first_query {
-			act_dt, err := a.NextActDate(time.Now(), a.Config.ActivationTime)
+			act_dt, err := a.NextActDate(a.now())
 			if err != nil {
 				a.Log.Errorf("NextActivationTime() failed: %v", err)
 				return err
 			}
 			dur := act_dt.Sub(time.Now())
 			a.Log.Debugf("Next activation time: %v, sleep interval: %v", act_dt, dur)
-			time.Sleep(dur)
+			if err := a.waitUntil(ctx, act_dt); err != nil {
+				a.Log.Infof("shutdown: no export in progress")
+				return nil
+			}
+		}
+
+		if len(a.destinations) > 0 {
+			if err := a.sendDestinations(ctx); err != nil {
+				if ctx.Err() != nil {
+					a.Log.Warnf("shutdown: export interrupted, data after the last checkpoints of destinations is not delivered and will be sent on the next run")
+					return nil
+				}
+				if first_query && !errors.Is(err, errBatchParked) && a.failedDestinations() == len(a.destinations) {
+					return err
+				}
+				a.Log.Errorf("sendDestinations() failed: %v", err)
+			}
+			first_query = false
+			continue
+		}
+
+		//undelivered batches of previous cycles go first
+		if _, _, err := a.replayOutbox(ctx, false); err != nil && ctx.Err() == nil {
+			a.Log.Errorf("replayOutbox() failed: %v", err)
 		}
 
 		//retrieve period for this client
-		dt_from, dt_to, err := a.FetchReportPerod(rep_period_url, a.Config.APIKey)
+		dt_from, dt_to, err := a.ReportPeriod(ctx, rep_period_url, a.Config.APIKey)
 		if err != nil {
+			if ctx.Err() != nil {
+				a.Log.Infof("shutdown: export period is not retrieved")
+				return nil
+			}
 			if first_query {
 				return err
 			}
-			a.Log.Errorf("FetchReportPerod() failed: %v", err)
+			a.Log.Errorf("ReportPeriod() failed: %v", err)
 			continue
 		}
 
 		//fetch data from MS server till no more is available
-		from := 0
-		count := DEF_PARAM_COUNT
+		if err := a.sendPeriod(ctx, dt_from, dt_to, send_data_url); err != nil {
+			if ctx.Err() != nil {
+				a.logUndelivered(dt_from, dt_to)
+				return nil
+			}
+			if first_query && !errors.Is(err, errBatchParked) {
+				return err
+			}
+			a.Log.Errorf("exportPeriod() failed: %v", err)
+		}
+		first_query = false
+	}
+}
+
+// sendPeriod sends data for the period, checks delivered on previous runs are skipped.
+func (a *App) sendPeriod(ctx context.Context, dateFrom, dateTo time.Time, url string) error {
+	url, err := periodURL(url, dateFrom, dateTo)
+	if err != nil {
+		return err
+	}
+	if a.Config.Stream.Enabled {
+		_, err := a.streamPeriod(ctx, dateFrom, dateTo, url, true)
+		return err
+	}
+	a.startRun()
+	err = a.exportPeriod(ctx, dateFrom, dateTo, func(rkData []RKRow, keys []CheckKey) error {
+		return a.deliver(ctx, rkData, keys, url)
+	})
+	a.logRun()
+	return err
+}
+
+// startRun resets the statistics of the run: page sizes and dead letters.
+func (a *App) startRun() {
+	a.pageSizes = []int{a.pageSize}
+	a.deadLetters = deadLetterStats{}
+}
+
+// logRun reports the statistics of the run.
+func (a *App) logRun() {
+	a.logPageSizes()
+	if a.Config.DeadLetterFile != "" {
+		a.logDeadLetters()
+	}
+}
+
+// logUndelivered reports the data left undelivered on shutdown.
+func (a *App) logUndelivered(dateFrom, dateTo time.Time) {
+	if a.checkpoints != nil {
+		if dt, ok := a.checkpoints.LowerBound(); ok {
+			dateFrom = dt
+		}
+	}
+	a.Log.Warnf("shutdown: export interrupted, data for period %s - %s after the last checkpoint is not delivered and will be sent on the next run",
+		dateFrom.Format(PARAM_DATE_LAYOUT), dateTo.Format(PARAM_DATE_LAYOUT))
+}
+
+// exportPeriod fetches data pages for the period from MS server
+// till no more is available and passes every page to the deliver function.
+// Pages are requested after the last key of the previous page (keyset mode)
+// or by row offset, depending on the query template.
+// Page size is read before every page, it may be changed by adaptive sizing.
+// Rows rejected by QueryRows() move the page position but are not delivered,
+// they are passed to rejectRows() after the rows of the page.
+// Rows without key (query without key columns) are paged by offset only.
+func (a *App) exportPeriod(ctx context.Context, dateFrom, dateTo time.Time, deliver func(rkData []RKRow, keys []CheckKey) error) error {
+	a.batchPeriod = [2]time.Time{dateFrom, dateTo}
+	from := 0
+	var after CheckKey
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		count := a.pageSize
+		var rk_data []RKRow
+		var rk_keys []CheckKey
 		for {
-			a.Log.Debugf("Fetching data for period: %s %s", dt_from.Format(PARAM_DATE_LAYOUT), dt_to.Format(PARAM_DATE_LAYOUT))
-			rk_data, err := a.FetchRKData(context.Background(), a.Config.MSCon, from, count, dt_from, dt_to)
+			a.Log.Debugf("Fetching data for period: %s %s, after: %+v", dateFrom.Format(PARAM_DATE_LAYOUT), dateTo.Format(PARAM_DATE_LAYOUT), after)
+			var err error
+			rk_data, rk_keys, err = a.fetchPage(ctx, from, count, after, dateFrom, dateTo)
 			if err != nil {
-				if first_query {
-					return err
-				}
-				a.Log.Errorf("FetchRKData() failed: %v", err)
-				//response with error?
+				return fmt.Errorf("FetchRKData() failed: %v", err)
+			}
+			if len(rk_data) < count || rk_keys[0].IsZero() || completeKeyCount(rk_keys) < len(rk_keys) {
 				break
 			}
+			//a check with more rows than the page, read it again to the end
+			count *= 2
+			a.Log.Debugf("page of %d records holds one check, fetching %d records", len(rk_data), count)
+		}
+
+		a.Log.Debugf("got records: %d", len(rk_data))
+		if len(rk_data) == 0 {
+			return nil //no data
+		}
+		if len(rk_data) >= count && !rk_keys[0].IsZero() {
+			//the page may end in the middle of a check with several rows,
+			//leave the rows of the last check for the next page
+			row_cnt := completeKeyCount(rk_keys)
+			rk_data, rk_keys = rk_data[:row_cnt], rk_keys[:row_cnt]
+		}
+		from += len(rk_data)
+		after = rk_keys[len(rk_keys)-1]
 
-			a.Log.Debugf("got records: %d", len(rk_data))
-			if len(rk_data) == 0 {
-				break //no data
+		rk_data, rk_keys, rejected, rejected_keys := dropRejected(rk_data, rk_keys)
+		if len(rk_data) > 0 {
+			if err := deliver(rk_data, rk_keys); err != nil {
+				return err
 			}
+		}
+		if err := a.rejectRows(rejected, rejected_keys); err != nil {
+			return err
+		}
+	}
+}
 
-			if err := a.SendData(rk_data, send_data_url, a.Config.APIKey); err != nil {
-				if first_query {
-					return err
+// completeKeyCount returns the number of rows without trailing rows sharing the last key.
+// If all rows have the same key, all of them are returned, exportPeriod()
+// reads such a page again with a larger count.
+func completeKeyCount(keys []CheckKey) int {
+	last := keys[len(keys)-1]
+	for i := len(keys) - 2; i >= 0; i-- {
+		if keys[i].Compare(last) != 0 {
+			return i + 1
+		}
+	}
+	return len(keys)
+}
+
+// deliver sends data page to url, checks delivered on previous runs are skipped.
+func (a *App) deliver(ctx context.Context, rkData []RKRow, keys []CheckKey, url string) error {
+	rk_data, rk_keys := a.filterDelivered(rkData, keys)
+	if len(rk_data) == 0 {
+		a.Log.Debugf("all records delivered before, skipping page")
+		return nil
+	}
+	return a.sendBatch(ctx, rk_data, rk_keys, url)
+}
+
+// sendBatch sends data page to url and moves checkpoints forward.
+// A batch too large for API is split in two on a check boundary,
+// the parts are sent one after another.
+// A batch with data rejected by API is bisected the same way, rejected checks
+// are written to the dead-letter file if it is set and a part of the batch
+// is accepted (see bisection).
+// A batch failed after all retries is written to the outbox, checkpoints
+// are moved forward as well and errBatchParked is returned.
+func (a *App) sendBatch(ctx context.Context, rkData []RKRow, keys []CheckKey, url string) error {
+	return a.sendPart(ctx, rkData, keys, url, nil)
+}
+
+// sendPart sends a batch or a part of a rejected batch being bisected (bis is set).
+// A failed part is not written to the outbox, the error is returned to the batch.
+func (a *App) sendPart(ctx context.Context, rkData []RKRow, keys []CheckKey, url string, bis *bisection) error {
+	err := a.SendData(ctx, rkData, keys, url, a.Config.APIKey)
+	if err != nil && ctx.Err() == nil {
+		too_large := a.batchTooLarge(err)
+		rejected := !too_large && a.Config.DeadLetterFile != "" && dataRejected(err)
+		i := splitIndex(keys)
+		switch {
+		case (too_large || rejected) && i > 0:
+			part_bis := bis
+			if too_large {
+				a.Log.Warnf("batch of %d records is too large: %v, sending it in two parts", len(rkData), err)
+				a.batchRejected(len(rkData), err)
+			} else {
+				a.Log.Warnf("batch of %d records rejected by API: %v, sending it in two parts to find bad checks", len(rkData), err)
+				a.deadLetters.bisected++
+				if part_bis == nil {
+					part_bis = &bisection{}
 				}
-				a.Log.Errorf("SendData() failed: %v", err)
-				break
 			}
-			from += count
+			part_err := a.sendPart(ctx, rkData[:i], keys[:i], url, part_bis)
+			if part_err == nil {
+				part_err = a.sendPart(ctx, rkData[i:], keys[i:], url, part_bis)
+			}
+			if bis != nil || part_bis == nil || part_bis.accepted {
+				return part_err
+			}
+			//nothing is accepted, the batch fails as a whole
+			if part_err == nil {
+				a.Log.Errorf("all %d checks of batch rejected by API, the batch is not written to the dead-letter file", len(part_bis.held))
+				part_err = err
+			}
+			err = part_err
+		case rejected && bis != nil && !bis.accepted:
+			bis.held = append(bis.held, heldCheck{rkData: rkData, keys: keys, err: err})
+			return nil
+		case rejected && bis != nil:
+			dl_err := a.deadLetter(rkData, keys, url, err)
+			if dl_err == nil {
+				return nil
+			}
+			a.Log.Errorf("deadLetter() failed: %v", dl_err)
 		}
-		first_query = false
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			a.Log.Warnf("shutdown: batch of %d records abandoned, it is not delivered", len(rkData))
+		} else if a.outbox != nil && bis == nil {
+			if park_err := a.parkBatch(rkData, keys, url, err); park_err != nil {
+				a.Log.Errorf("parkBatch() failed: %v", park_err)
+			} else if err := a.commitCheckpoints(keys); err != nil {
+				return fmt.Errorf("commitCheckpoints() failed: %v", err)
+			} else {
+				return fmt.Errorf("SendData() failed, %w: %v", errBatchParked, err)
+			}
+		}
+		return fmt.Errorf("SendData() failed: %v", err)
+	}
+	if bis != nil && !bis.accepted {
+		//the checks rejected before are bad
+		bis.accepted = true
+		for _, h := range bis.held {
+			if err := a.deadLetter(h.rkData, h.keys, url, h.err); err != nil {
+				return fmt.Errorf("deadLetter() failed: %v", err)
+			}
+		}
+		bis.held = nil
+	}
+	if err := a.commitCheckpoints(keys); err != nil {
+		return fmt.Errorf("commitCheckpoints() failed: %v", err)
 	}
 	return nil
 }
 
 // SetSQLFilter builds sql filter string.
+// Restaurant and cash group names are never spliced into the query text,
+// every name is passed as a named parameter (@pRestaurant1, @pCashGroup1...).
 func (a *App) SetSQLFilter() {
+	a.setSQLFilter(a.Config.Restaurants, a.Config.CashGroups)
+}
+
+// setSQLFilter builds sql filter string for restaurant and cash group names,
+// empty list means no filter.
+func (a *App) setSQLFilter(restaurants, cashGroups []string) {
 	a.sqlFilter = ""
+	a.sqlFilterArgs = nil
 
 	var cond strings.Builder
-	if len(a.Config.Restaurants) > 0 {
+	if len(restaurants) > 0 {
 		// add restaurant condition
-		var rest_cond strings.Builder
-		for _, rest := range a.Config.Restaurants {
-			if rest_cond.Len() > 0 {
-				rest_cond.WriteString(" OR ")
-			}
-			rest_cond.WriteString(fmt.Sprintf("RESTAURANTS.NAME = '%s'", rest))
-		}
-		if cond.Len() > 0 {
-			cond.WriteString(" AND ")
-		}
-		cond.WriteString("(")
-		cond.WriteString(rest_cond.String())
-		cond.WriteString(")")
+		cond.WriteString(a.sqlInCondition("RESTAURANTS.NAME", "pRestaurant", restaurants))
 	}
-	if len(a.Config.CashGroups) > 0 {
+	if len(cashGroups) > 0 {
 		// add cash group condition
-		var gr_cond strings.Builder
-		for _, gr := range a.Config.CashGroups {
-			if gr_cond.Len() > 0 {
-				gr_cond.WriteString(" OR ")
-			}
-			gr_cond.WriteString(fmt.Sprintf("CASHGROUPS.NAME = '%s'", gr))
-		}
 		if cond.Len() > 0 {
 			cond.WriteString(" AND ")
 		}
-		cond.WriteString("(")
-		cond.WriteString(gr_cond.String())
-		cond.WriteString(")")
+		cond.WriteString(a.sqlInCondition("CASHGROUPS.NAME", "pCashGroup", cashGroups))
 	}
 	if cond.Len() > 0 {
 		a.sqlFilter = cond.String()
 	}
 }
+
+// sqlInCondition returns "field IN (@prefix1, @prefix2...)" condition
+// and adds values to the list of filter arguments.
+func (a *App) sqlInCondition(field string, paramPrefix string, values []string) string {
+	var cond strings.Builder
+	cond.WriteString(field)
+	cond.WriteString(" IN (")
+	for i, val := range values {
+		if i > 0 {
+			cond.WriteString(", ")
+		}
+		param_name := fmt.Sprintf("%s%d", paramPrefix, i+1)
+		cond.WriteString("@" + param_name)
+		a.sqlFilterArgs = append(a.sqlFilterArgs, sql.Named(param_name, val))
+	}
+	cond.WriteString(")")
+	return cond.String()
+}
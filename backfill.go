@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+const BACKFILL_EXT = ".backfill.json"
+
+// BackfillState is the progress of backfill, it is kept in a file
+// till the whole range is sent, so an interrupted backfill is resumed
+// from the day after the last completed one.
+type BackfillState struct {
+	DateFrom string `json:"dateFrom"` // range in format ReportPeriodLoyout
+	DateTo   string `json:"dateTo"`
+	Done     string `json:"done"` // last completed day
+}
+
+// BackfillFileName returns default backfill state file name for the configuration file.
+func BackfillFileName(configFile string) string {
+	return strings.TrimSuffix(configFile, JSON_EXT) + BACKFILL_EXT
+}
+
+func loadBackfillState(fileName string) (*BackfillState, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("os.ReadFile() failed: %v", err)
+	}
+	st := &BackfillState{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal() failed: %v", err)
+	}
+	return st, nil
+}
+
+func (st *BackfillState) save(fileName string) error {
+	data, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent() failed: %v", err)
+	}
+	return writeFileAtomic(fileName, data)
+}
+
+// Backfill sends all data from dateFrom to dateTo (whole days) to API
+// day by day, checkpoints do not filter the data. Completed days are written
+// to stateFile, if it contains the same range, the days already sent are skipped
+// unless restart is set. The file is removed when the whole range is sent.
+func (a *App) Backfill(ctx context.Context, dateFrom, dateTo time.Time, stateFile string, restart bool) error {
+	var send_data_url string
+	var err error
+	if len(a.destinations) > 0 {
+		err = a.destinationURLs()
+	} else {
+		_, send_data_url, err = a.APIUrls()
+	}
+	if err != nil {
+		return err
+	}
+	if err := a.OpenDB(ctx); err != nil {
+		return err
+	}
+	defer a.CloseDB()
+
+	return a.backfill(ctx, dateFrom, dateTo, send_data_url, stateFile, restart)
+}
+
+func (a *App) backfill(ctx context.Context, dateFrom, dateTo time.Time, url string, stateFile string, restart bool) error {
+	first_day := time.Date(dateFrom.Year(), dateFrom.Month(), dateFrom.Day(), 0, 0, 0, 0, a.location)
+	last_day := time.Date(dateTo.Year(), dateTo.Month(), dateTo.Day(), 0, 0, 0, 0, a.location)
+	if last_day.Before(first_day) {
+		return fmt.Errorf("date to %s is before date from %s", last_day.Format(ReportPeriodLoyout), first_day.Format(ReportPeriodLoyout))
+	}
+	state := &BackfillState{DateFrom: first_day.Format(ReportPeriodLoyout), DateTo: last_day.Format(ReportPeriodLoyout)}
+	a.startRun()
+	defer a.logRun()
+
+	day_cnt := 0
+	for day := first_day; !day.After(last_day); day = day.AddDate(0, 0, 1) {
+		day_cnt++
+	}
+
+	start_day := first_day
+	if !restart {
+		prev_state, err := loadBackfillState(stateFile)
+		if err != nil {
+			return fmt.Errorf("loadBackfillState() failed: %v", err)
+		}
+		if prev_state != nil && prev_state.DateFrom == state.DateFrom && prev_state.DateTo == state.DateTo && prev_state.Done != "" {
+			done, err := time.ParseInLocation(ReportPeriodLoyout, prev_state.Done, a.location)
+			if err != nil {
+				return fmt.Errorf("invalid backfill state %s: %v", stateFile, err)
+			}
+			state.Done = prev_state.Done
+			start_day = done.AddDate(0, 0, 1)
+			a.Log.Infof("backfill %s - %s resumed after %s", state.DateFrom, state.DateTo, state.Done)
+		}
+	}
+
+	day_n := 0
+	total_cnt := 0
+	for day := first_day; !day.After(last_day); day = day.AddDate(0, 0, 1) {
+		day_n++
+		if day.Before(start_day) {
+			continue
+		}
+		day_str := day.Format(ReportPeriodLoyout)
+		a.Log.Infof("backfill day %d/%d: %s", day_n, day_cnt, day_str)
+
+		cnt := 0
+		day_url, err := periodURL(url, day, endOfDay(day))
+		switch {
+		case err != nil:
+		case len(a.destinations) > 0:
+			cnt, err = a.backfillDestinations(ctx, day)
+		case a.Config.Stream.Enabled:
+			cnt, err = a.streamPeriod(ctx, day, endOfDay(day), day_url, false)
+		default:
+			err = a.exportPeriod(ctx, day, endOfDay(day), func(rkData []RKRow, keys []CheckKey) error {
+				if err := a.sendBatch(ctx, rkData, keys, day_url); err != nil {
+					return err
+				}
+				cnt += len(rkData)
+				return nil
+			})
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				a.Log.Warnf("shutdown: backfill day %s interrupted after %d records, run backfill again to resume from this day", day_str, cnt)
+			}
+			return fmt.Errorf("backfill day %s failed after %d records: %v", day_str, cnt, err)
+		}
+		total_cnt += cnt
+
+		state.Done = day_str
+		if err := state.save(stateFile); err != nil {
+			return fmt.Errorf("backfill state save failed: %v", err)
+		}
+		a.Log.Infof("backfill day %d/%d: %s, sent %d records", day_n, day_cnt, day_str, cnt)
+	}
+
+	if err := os.Remove(stateFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		a.Log.Errorf("os.Remove() failed: %v", err)
+	}
+	a.Log.Infof("backfill %s - %s completed, sent %d records", state.DateFrom, state.DateTo, total_cnt)
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Page size defaults.
+const (
+	DEF_BATCH_MIN_SIZE      = 10
+	DEF_BATCH_MAX_SIZE      = 1000
+	DEF_BATCH_MAX_BYTES     = 1024 * 1024
+	DEF_BATCH_FAST_RESPONSE = 2000 // milliseconds
+)
+
+// errBatchTooLarge is returned by SendData() for a batch exceeding Batch.MaxBytes.
+var errBatchTooLarge = errors.New("batch exceeds maxBytes")
+
+// setDefaults fills zero values with defaults and validates the configuration.
+func (b *Batch) setDefaults() error {
+	if b.Size == 0 {
+		b.Size = DEF_PARAM_COUNT
+	}
+	if b.MinSize == 0 {
+		b.MinSize = min(DEF_BATCH_MIN_SIZE, b.Size)
+	}
+	if b.MaxSize == 0 {
+		b.MaxSize = max(DEF_BATCH_MAX_SIZE, b.Size)
+	}
+	if b.MaxBytes == 0 {
+		b.MaxBytes = DEF_BATCH_MAX_BYTES
+	}
+	if b.FastResponse == 0 {
+		b.FastResponse = DEF_BATCH_FAST_RESPONSE
+	}
+	switch {
+	case b.MinSize < 1:
+		return fmt.Errorf("batch minSize must be positive")
+	case b.Size < b.MinSize || b.Size > b.MaxSize:
+		return fmt.Errorf("batch size must be in range minSize..maxSize")
+	case b.MaxBytes < 0 || b.FastResponse < 0:
+		return fmt.Errorf("batch maxBytes and fastResponse must not be negative")
+	}
+	return nil
+}
+
+// setPageSize changes page size within Batch limits, every change is logged
+// and kept in pageSizes for the run summary.
+func (a *App) setPageSize(size int, reason string) {
+	b := &a.Config.Batch
+	size = max(b.MinSize, min(size, b.MaxSize))
+	if size == a.pageSize {
+		return
+	}
+	a.Log.Infof("page size %d -> %d: %s", a.pageSize, size, reason)
+	a.pageSize = size
+	a.pageSizes = append(a.pageSizes, size)
+}
+
+// batchSent grows page size twice in adaptive mode after API answered
+// a full page faster than Batch.FastResponse. The size is limited by
+// Batch.MaxBytes estimated from the average encoded row size.
+func (a *App) batchSent(rows, bytes int, resp time.Duration) {
+	b := &a.Config.Batch
+	if !b.Adaptive || rows == 0 || rows < a.pageSize/2 || resp >= time.Duration(b.FastResponse)*time.Millisecond {
+		return
+	}
+	size := a.pageSize * 2
+	if row_bytes := (bytes + rows - 1) / rows; b.MaxBytes > 0 && row_bytes > 0 {
+		size = min(size, b.MaxBytes/row_bytes)
+	}
+	if size > a.pageSize {
+		a.setPageSize(size, fmt.Sprintf("%d records sent in %v", rows, resp.Round(time.Millisecond)))
+	}
+}
+
+// batchRejected halves page size in adaptive mode after a batch of rows
+// was too large for API.
+func (a *App) batchRejected(rows int, err error) {
+	if a.Config.Batch.Adaptive {
+		a.setPageSize(min(a.pageSize, rows)/2, err.Error())
+	}
+}
+
+// batchTooLarge returns true if a smaller batch may succeed: the batch exceeds
+// Batch.MaxBytes, API rejected it with 413 Payload Too Large or,
+// in adaptive mode, the request timed out.
+func (a *App) batchTooLarge(err error) bool {
+	var api_err *APIError
+	switch {
+	case errors.Is(err, errBatchTooLarge):
+		return true
+	case errors.As(err, &api_err):
+		return api_err.StatusCode == http.StatusRequestEntityTooLarge
+	}
+	return a.Config.Batch.Adaptive && timeoutError(err)
+}
+
+// timeoutError returns true for request timeouts.
+func timeoutError(err error) bool {
+	var net_err net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &net_err) && net_err.Timeout())
+}
+
+// splitIndex returns the check boundary nearest to the middle of the batch,
+// 0 if the batch is a single check and can not be split.
+func splitIndex(keys []CheckKey) int {
+	mid := len(keys) / 2
+	for d := 0; d < len(keys); d++ {
+		if i := mid - d; i > 0 && !sameCheck(keys[i-1], keys[i]) {
+			return i
+		}
+		if i := mid + d; i > 0 && i < len(keys) && !sameCheck(keys[i-1], keys[i]) {
+			return i
+		}
+	}
+	return 0
+}
+
+// logPageSizes reports page sizes chosen during the run if the size changed.
+func (a *App) logPageSizes() {
+	if len(a.pageSizes) < 2 {
+		return
+	}
+	sizes := make([]string, len(a.pageSizes))
+	for i, size := range a.pageSizes {
+		sizes[i] = fmt.Sprint(size)
+	}
+	a.Log.Infof("page sizes in this run: %s", strings.Join(sizes, ", "))
+}
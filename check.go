@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export schemas.
+const (
+	SCHEMA_CHECK = "check" // default: rows are mapped onto Check
+	SCHEMA_RAW   = "raw"   // rows are sent as RKDate with column names as keys
+)
+
+// RAW_COL_CHECK_ID is added to raw schema rows, the value is CheckKey.ID().
+const RAW_COL_CHECK_ID = "CHECK_ID"
+
+// CHECK_SCHEMA_VERSION is the version of Check structure,
+// it is sent with every batch. Increment on any change of the fields.
+const CHECK_SCHEMA_VERSION = 3
+
+// Check is a check row of the default query.
+// Every field is filled from the query column with the name in the comment,
+// mandatory columns must be present in the query and must not be NULL.
+// Optional values which may be NULL are pointers, NULL is sent as null.
+type Check struct {
+	RestaurantId    int64      `json:"restaurant_id"`    // RESTAURANTID, mandatory
+	CashGroupId     int64      `json:"cash_group_id"`    // CASHGROUPID, mandatory, cash server (PRINTCHECKS.MIDSERVER)
+	VisitId         int64      `json:"visit_id"`         // VISITID, mandatory
+	CheckUni        int64      `json:"check_uni"`        // CHECKUNI, mandatory, check identifier within visit
+	CheckId         string     `json:"check_id"`         // not a column, CheckKey.ID(): unique check identifier for deduplication
+	CheckOpen       *time.Time `json:"check_open"`       // CHECKOPEN, order open time
+	CheckClose      time.Time  `json:"check_close"`      // CHECKCLOSE, mandatory, order close time
+	VisitStartTime  *time.Time `json:"visit_start_time"` // VISITSTARTTIME, precheck time
+	OrderNum        string     `json:"order_num"`        // ORDERNUM, mandatory, order number
+	FiscDocNum      *string    `json:"fisc_doc_num"`     // FISCDOCNUM, fiscal document number
+	OrderSum        Decimal    `json:"order_sum"`        // ORDERSUM, mandatory, order sum before discounts
+	PaySum          Decimal    `json:"pay_sum"`          // PAYSUM, mandatory, sum paid after discounts
+	ItemCount       int64      `json:"item_count"`       // ITEMCOUNT, number of items
+	PayType         string     `json:"pay_type"`         // PAYMETHOD, payment type (cash/card/other)
+	DiscountSum     Decimal    `json:"discount_sum"`     // BONUSSUM, bonuses/discounts used
+	DiscountComment string     `json:"discount_comment"` // BONUSCOMMENT, discount comment
+}
+
+// checkColumn describes how a query column is set to Check.
+type checkColumn struct {
+	name      string
+	mandatory bool
+	set       func(c *Check, val interface{}, quoted bool) error
+}
+
+var checkColumns = []checkColumn{
+	{"RESTAURANTID", true, func(c *Check, v interface{}, q bool) (err error) { c.RestaurantId, err = checkInt(v); return }},
+	{"CASHGROUPID", true, func(c *Check, v interface{}, q bool) (err error) { c.CashGroupId, err = checkInt(v); return }},
+	{"VISITID", true, func(c *Check, v interface{}, q bool) (err error) { c.VisitId, err = checkInt(v); return }},
+	{"CHECKUNI", true, func(c *Check, v interface{}, q bool) (err error) { c.CheckUni, err = checkInt(v); return }},
+	{"CHECKOPEN", false, func(c *Check, v interface{}, q bool) (err error) { c.CheckOpen, err = optTime(v); return }},
+	{"CHECKCLOSE", true, func(c *Check, v interface{}, q bool) (err error) { c.CheckClose, err = checkTime(v); return }},
+	{"VISITSTARTTIME", false, func(c *Check, v interface{}, q bool) (err error) { c.VisitStartTime, err = optTime(v); return }},
+	{"ORDERNUM", true, func(c *Check, v interface{}, q bool) (err error) { c.OrderNum, err = checkString(v); return }},
+	{"FISCDOCNUM", false, func(c *Check, v interface{}, q bool) (err error) { c.FiscDocNum, err = optString(v); return }},
+	{"ORDERSUM", true, func(c *Check, v interface{}, q bool) (err error) { c.OrderSum, err = checkDecimal(v, q); return }},
+	{"PAYSUM", true, func(c *Check, v interface{}, q bool) (err error) { c.PaySum, err = checkDecimal(v, q); return }},
+	{"ITEMCOUNT", false, func(c *Check, v interface{}, q bool) (err error) { c.ItemCount, err = checkInt(v); return }},
+	{"PAYMETHOD", false, func(c *Check, v interface{}, q bool) (err error) { c.PayType, err = checkString(v); return }},
+	{"BONUSSUM", false, func(c *Check, v interface{}, q bool) (err error) { c.DiscountSum, err = checkDecimal(v, q); return }},
+	{"BONUSCOMMENT", false, func(c *Check, v interface{}, q bool) (err error) { c.DiscountComment, err = checkString(v); return }},
+}
+
+// ValidateCheckColumns checks that all mandatory Check columns are returned by the query.
+func ValidateCheckColumns(columns []string) error {
+	col_m := make(map[string]bool, len(columns))
+	for _, col := range columns {
+		col_m[strings.ToUpper(col)] = true
+	}
+	var missing []string
+	for _, col := range checkColumns {
+		if col.mandatory && !col_m[col.name] {
+			missing = append(missing, col.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("query does not return mandatory columns: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// NewCheck maps query row onto Check. Row values are converted by FetchRKData().
+// An error is returned if a mandatory value is NULL or a value has unexpected type.
+// Decimal fields are marshaled in decimalFormat: number|string.
+func NewCheck(row RKDate, decimalFormat string) (*Check, error) {
+	row_m := make(map[string]interface{}, len(row))
+	for col, val := range row {
+		row_m[strings.ToUpper(col)] = val
+	}
+	c := &Check{}
+	for _, col := range checkColumns {
+		val, ok := row_m[col.name]
+		if !ok || val == nil {
+			if col.mandatory {
+				return nil, fmt.Errorf("mandatory column %s is NULL", col.name)
+			}
+			continue
+		}
+		if err := col.set(c, val, decimalFormat == DECIMAL_FORMAT_STRING); err != nil {
+			return nil, fmt.Errorf("column %s: %v", col.name, err)
+		}
+	}
+	return c, nil
+}
+
+func checkInt(val interface{}) (int64, error) {
+	switch v := val.(type) {
+	case int64:
+		return v, nil
+	case float64:
+		if v != float64(int64(v)) {
+			return 0, fmt.Errorf("%v is not an integer", v)
+		}
+		return int64(v), nil
+	case Decimal:
+		int_part, frac, _ := strings.Cut(v.String(), ".")
+		if strings.Trim(frac, "0") != "" {
+			return 0, fmt.Errorf("%s is not an integer", v)
+		}
+		return strconv.ParseInt(int_part, 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected type %T, integer expected", val)
+}
+
+func checkDecimal(val interface{}, quoted bool) (Decimal, error) {
+	switch v := val.(type) {
+	case Decimal:
+		v.quoted = quoted
+		return v, nil
+	case int64:
+		return DecimalFromInt(v, quoted), nil
+	case float64:
+		//FLOAT column, the value is not exact anyway
+		return ParseDecimal(strconv.FormatFloat(v, 'f', -1, 64), quoted)
+	}
+	return Decimal{}, fmt.Errorf("unexpected type %T, number expected", val)
+}
+
+func checkString(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return fmt.Sprintf("%d", v), nil
+	}
+	return "", fmt.Errorf("unexpected type %T, string expected", val)
+}
+
+func checkTime(val interface{}) (time.Time, error) {
+	if v, ok := val.(time.Time); ok {
+		return v, nil
+	}
+	return time.Time{}, fmt.Errorf("unexpected type %T, datetime expected", val)
+}
+
+// optTime returns the datetime of an optional column, NULL columns are not set.
+func optTime(val interface{}) (*time.Time, error) {
+	t, err := checkTime(val)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// optString returns the string of an optional column, NULL columns are not set.
+func optString(val interface{}) (*string, error) {
+	s, err := checkString(val)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
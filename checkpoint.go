@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CHECKPOINT_EXT = ".checkpoint.json"
+
+// Key columns of the query, used to identify a delivered check.
+const (
+	KEY_COL_RESTAURANT = "RESTAURANTID"
+	KEY_COL_CASH_GROUP = "CASHGROUPID" // PRINTCHECKS.MIDSERVER
+	KEY_COL_VISIT      = "VISITID"
+	KEY_COL_CHECK_UNI  = "CHECKUNI"
+	KEY_COL_CLOSE      = "CHECKCLOSE"
+)
+
+// CheckKey identifies a check row. Checks are ordered by
+// CloseTime, CashGroup, Visit, CheckUni.
+type CheckKey struct {
+	Restaurant int64     `json:"restaurant"`
+	CloseTime  time.Time `json:"closeTime"`
+	CashGroup  int64     `json:"cashGroup"`
+	Visit      int64     `json:"visit"`
+	CheckUni   int64     `json:"checkUni"`
+}
+
+// IsZero returns true for the key of a row of a query without key columns,
+// such rows are not checkpointed.
+func (k CheckKey) IsZero() bool {
+	return k == CheckKey{}
+}
+
+// Compare returns -1, 0, +1 if k is before, equal or after k2.
+// Restaurant is not a part of the order.
+func (k CheckKey) Compare(k2 CheckKey) int {
+	if c := k.CloseTime.Compare(k2.CloseTime); c != 0 {
+		return c
+	}
+	for _, p := range [][2]int64{{k.CashGroup, k2.CashGroup}, {k.Visit, k2.Visit}, {k.CheckUni, k2.CheckUni}} {
+		if p[0] < p[1] {
+			return -1
+		} else if p[0] > p[1] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// ID returns stable check identifier: restaurant, cash group, visit and check.
+// Rows of the same check (several payment types) have the same ID.
+func (k CheckKey) ID() string {
+	return fmt.Sprintf("%d:%d:%d:%d", k.Restaurant, k.CashGroup, k.Visit, k.CheckUni)
+}
+
+// GroupID returns checkpoint group identifier: restaurant and cash group.
+func (k CheckKey) GroupID() string {
+	return fmt.Sprintf("%d:%d", k.Restaurant, k.CashGroup)
+}
+
+// CheckpointStore keeps the last delivered check per restaurant and cash group.
+// The store is a json file next to the configuration file.
+type CheckpointStore struct {
+	fileName string
+	mx       sync.Mutex
+
+	// Since is the lower bound for groups without a checkpoint, set by Rewind().
+	Since       time.Time           `json:"since,omitempty"`
+	Checkpoints map[string]CheckKey `json:"checkpoints"`
+}
+
+// CheckpointFileName returns default checkpoint file name for the configuration file.
+func CheckpointFileName(configFile string) string {
+	return strings.TrimSuffix(configFile, JSON_EXT) + CHECKPOINT_EXT
+}
+
+// LoadCheckpointStore reads the store from file.
+// A missing file gives an empty store.
+func LoadCheckpointStore(fileName string) (*CheckpointStore, error) {
+	st := &CheckpointStore{fileName: fileName, Checkpoints: make(map[string]CheckKey)}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return st, nil
+		}
+		return nil, fmt.Errorf("os.ReadFile() failed: %v", err)
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	if len(bytes.TrimSpace(data)) == 0 {
+		return st, nil
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal() failed: %v", err)
+	}
+	if st.Checkpoints == nil {
+		st.Checkpoints = make(map[string]CheckKey)
+	}
+	return st, nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to name,
+// so the file is never left half written.
+func writeFileAtomic(name string, data []byte) error {
+	tmp_file := name + ".tmp"
+	if err := os.WriteFile(tmp_file, data, 0666); err != nil {
+		return fmt.Errorf("os.WriteFile() failed: %v", err)
+	}
+	if err := os.Rename(tmp_file, name); err != nil {
+		return fmt.Errorf("os.Rename() failed: %v", err)
+	}
+	return nil
+}
+
+// Save writes the store atomically (see writeFileAtomic()).
+func (st *CheckpointStore) Save() error {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+
+	data, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent() failed: %v", err)
+	}
+	return writeFileAtomic(st.fileName, data)
+}
+
+// LowerBound returns the earliest checkpoint time.
+// False is returned if the store is empty.
+func (st *CheckpointStore) LowerBound() (time.Time, bool) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+
+	bound := st.Since
+	for _, key := range st.Checkpoints {
+		if bound.IsZero() || key.CloseTime.Before(bound) {
+			bound = key.CloseTime
+		}
+	}
+	return bound, !bound.IsZero()
+}
+
+// Delivered returns true if the check is not after the checkpoint of its group.
+// A row without key is never delivered.
+func (st *CheckpointStore) Delivered(key CheckKey) bool {
+	if key.IsZero() {
+		return false
+	}
+	st.mx.Lock()
+	defer st.mx.Unlock()
+
+	last, ok := st.Checkpoints[key.GroupID()]
+	return ok && key.Compare(last) <= 0
+}
+
+// Update moves group checkpoints forward to the given keys, rows without key are skipped.
+func (st *CheckpointStore) Update(keys []CheckKey) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+
+	for _, key := range keys {
+		if key.IsZero() {
+			continue
+		}
+		group_id := key.GroupID()
+		if last, ok := st.Checkpoints[group_id]; !ok || key.Compare(last) > 0 {
+			st.Checkpoints[group_id] = key
+		}
+	}
+}
+
+// Reset removes all checkpoints. The next run takes the period from API.
+func (st *CheckpointStore) Reset() {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+
+	st.Since = time.Time{}
+	st.Checkpoints = make(map[string]CheckKey)
+}
+
+// Rewind moves all checkpoints back to date, checks closed at date or later
+// are exported again.
+func (st *CheckpointStore) Rewind(date time.Time) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+
+	st.Since = date
+	for group_id, key := range st.Checkpoints {
+		if !key.CloseTime.Before(date) {
+			st.Checkpoints[group_id] = CheckKey{Restaurant: key.Restaurant, CashGroup: key.CashGroup, CloseTime: date}
+		}
+	}
+}
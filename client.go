@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// API http client defaults.
+const (
+	HTTP_CONNECT_TIMEOUT_MS         = 10 * 1000
+	HTTP_TLS_HANDSHAKE_TIMEOUT_MS   = 10 * 1000
+	HTTP_RESPONSE_HEADER_TIMEOUT_MS = 60 * 1000
+	HTTP_TIMEOUT_MS                 = 2 * 60 * 1000
+	HTTP_IDLE_CONN_TIMEOUT_MS       = 90 * 1000
+	HTTP_MAX_IDLE_CONNS             = 2
+	HTTP_KEEP_ALIVE_MS              = 30 * 1000
+
+	HTTP_PROXY_NONE = "none" // do not use proxy even if it is set in environment
+)
+
+// newHTTPClient returns API client. The client is shared by all requests,
+// so connections are kept alive and reused between pages.
+// Gzip compressed responses are accepted and decompressed by the transport.
+// Proxy is taken from configuration or from HTTP_PROXY, HTTPS_PROXY, NO_PROXY
+// environment variables.
+func newHTTPClient(conf HTTPClient) (*http.Client, error) {
+	ms := func(v, def int) time.Duration {
+		return time.Duration(defInt(v, def)) * time.Millisecond
+	}
+
+	proxy := http.ProxyFromEnvironment
+	switch conf.Proxy {
+	case "":
+	case HTTP_PROXY_NONE:
+		proxy = nil
+	default:
+		proxy_url, err := url.Parse(conf.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %v", err)
+		}
+		if proxy_url.Scheme == "" || proxy_url.Host == "" {
+			return nil, fmt.Errorf("invalid proxy url: %s, scheme and host are required", conf.Proxy)
+		}
+		proxy = http.ProxyURL(proxy_url)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   ms(conf.ConnectTimeout, HTTP_CONNECT_TIMEOUT_MS),
+		KeepAlive: HTTP_KEEP_ALIVE_MS * time.Millisecond,
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   ms(conf.TLSHandshakeTimeout, HTTP_TLS_HANDSHAKE_TIMEOUT_MS),
+		ResponseHeaderTimeout: ms(conf.ResponseHeaderTimeout, HTTP_RESPONSE_HEADER_TIMEOUT_MS),
+		IdleConnTimeout:       ms(conf.IdleConnTimeout, HTTP_IDLE_CONN_TIMEOUT_MS),
+		MaxIdleConns:          HTTP_MAX_IDLE_CONNS,
+		MaxIdleConnsPerHost:   HTTP_MAX_IDLE_CONNS,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   ms(conf.Timeout, HTTP_TIMEOUT_MS),
+	}, nil
+}
+
+// gzipData compresses request body.
+func gzipData(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("gzip.Write() failed: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("gzip.Close() failed: %v", err)
+	}
+	return buf.Bytes(), nil
+}
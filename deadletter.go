@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const DEAD_LETTER_EXT = ".deadletter.jsonl"
+
+// DeadLetter is a check rejected by API, one json line of the dead-letter file.
+type DeadLetter struct {
+	Time       time.Time  `json:"time"`
+	URL        string     `json:"url"`
+	CheckId    string     `json:"checkId"`
+	Keys       []CheckKey `json:"keys"`
+	StatusCode int        `json:"statusCode"`
+	Error      string     `json:"error"` // API response body
+	Rows       []RKRow    `json:"rows"`
+}
+
+// deadLetterStats are the numbers of rejected checks in the run.
+type deadLetterStats struct {
+	checks   int // checks written to the dead-letter file
+	rows     int
+	bisected int // rejected batches split to find bad checks
+	rejected int // rows which can not be formatted
+}
+
+// bisection is the state of a batch rejected by API being bisected to find bad checks.
+// Rejected checks are held till a part of the batch is accepted: if every part
+// is rejected, the cause is not in the checks (schema version, API key...),
+// the batch fails as a whole and nothing is written to the dead-letter file.
+type bisection struct {
+	accepted bool // a part of the batch is accepted
+	held     []heldCheck
+}
+
+// heldCheck is a rejected check of a bisection.
+type heldCheck struct {
+	rkData []RKRow
+	keys   []CheckKey
+	err    error
+}
+
+// DeadLetterFileName returns default dead-letter file name for the configuration file.
+func DeadLetterFileName(configFile string) string {
+	return strings.TrimSuffix(configFile, JSON_EXT) + DEAD_LETTER_EXT
+}
+
+// dataRejected returns true if API rejected the data of the batch:
+// 4xx statuses except the ones caused by configuration (401, 403, 404, 405),
+// size (413) or load (408, 429). Such a batch is bisected to find bad checks.
+func dataRejected(err error) bool {
+	var api_err *APIError
+	if !errors.As(err, &api_err) || api_err.StatusCode < 400 || api_err.StatusCode >= 500 {
+		return false
+	}
+	switch api_err.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed,
+		http.StatusRequestTimeout, http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return false
+	}
+	return true
+}
+
+// deadLetter appends the rows of a rejected check to DeadLetterFile
+// with API error and moves checkpoints forward.
+func (a *App) deadLetter(rkData []RKRow, keys []CheckKey, url string, sendErr error) error {
+	dl := DeadLetter{
+		Time:  time.Now(),
+		URL:   url,
+		Keys:  keys,
+		Error: sendErr.Error(),
+		Rows:  rkData,
+	}
+	if len(keys) > 0 {
+		dl.CheckId = keys[0].ID()
+	}
+	var api_err *APIError
+	if errors.As(sendErr, &api_err) {
+		dl.StatusCode = api_err.StatusCode
+		dl.Error = api_err.Body
+	}
+	if err := a.writeDeadLetter(&dl); err != nil {
+		return err
+	}
+	a.Log.Errorf("check %s rejected by API: %v, %d records written to %s", dl.CheckId, sendErr, len(rkData), a.Config.DeadLetterFile)
+	a.deadLetters.checks++
+	a.deadLetters.rows += len(rkData)
+
+	if err := a.commitCheckpoints(keys); err != nil {
+		return fmt.Errorf("commitCheckpoints() failed: %v", err)
+	}
+	return nil
+}
+
+// writeDeadLetter appends a line to DeadLetterFile.
+func (a *App) writeDeadLetter(dl *DeadLetter) error {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("json.Marshal() failed: %v", err)
+	}
+	f, err := os.OpenFile(a.Config.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile() failed: %v", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("file.Write() failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("file.Close() failed: %v", err)
+	}
+	return nil
+}
+
+// dropRejected removes rows rejected by QueryRows() from the page.
+// It returns the rest of the page and the rejected rows with their keys.
+func dropRejected(rkData []RKRow, keys []CheckKey) ([]RKRow, []CheckKey, []RKRow, []CheckKey) {
+	var rejected []RKRow
+	var rejected_keys []CheckKey
+	rk_data := rkData[:0:0]
+	rk_keys := keys[:0:0]
+	for i, row := range rkData {
+		if _, ok := row.(*rejectedRow); ok {
+			rejected = append(rejected, row)
+			rejected_keys = append(rejected_keys, keys[i])
+			continue
+		}
+		rk_data = append(rk_data, row)
+		rk_keys = append(rk_keys, keys[i])
+	}
+	return rk_data, rk_keys, rejected, rejected_keys
+}
+
+// rejectRows writes rows which can not be formatted to DeadLetterFile
+// (status code 0) and moves checkpoints past them. If the file is not set,
+// the rows are logged. Rows delivered or rejected before are skipped.
+// It is called after the rows of the page before them are delivered.
+func (a *App) rejectRows(rows []RKRow, keys []CheckKey) error {
+	for i, row := range rows {
+		key := keys[i]
+		if a.checkpoints != nil && a.checkpoints.Delivered(key) {
+			continue
+		}
+		rej := row.(*rejectedRow)
+		if a.Config.DeadLetterFile == "" {
+			a.Log.Errorf("row rejected, key: %+v, %v", key, rej.err)
+			continue
+		}
+		dl := DeadLetter{
+			Time:    time.Now(),
+			CheckId: key.ID(),
+			Keys:    []CheckKey{key},
+			Error:   rej.err.Error(),
+			Rows:    []RKRow{rej.row},
+		}
+		if err := a.writeDeadLetter(&dl); err != nil {
+			return err
+		}
+		a.Log.Errorf("row of check %s rejected: %v, written to %s", dl.CheckId, rej.err, a.Config.DeadLetterFile)
+		a.deadLetters.rejected++
+		if err := a.commitCheckpoints(dl.Keys); err != nil {
+			return fmt.Errorf("commitCheckpoints() failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// logDeadLetters reports checks rejected during the run.
+func (a *App) logDeadLetters() {
+	if a.deadLetters.checks == 0 && a.deadLetters.rejected == 0 {
+		a.Log.Infof("dead letters in this run: none")
+		return
+	}
+	a.Log.Warnf("dead letters in this run: %d checks, %d records, rejected batches: %d, rows not formatted: %d, see %s",
+		a.deadLetters.checks, a.deadLetters.rows, a.deadLetters.bisected, a.deadLetters.rejected, a.Config.DeadLetterFile)
+}
+
+// deadLetterEntry is a line of the dead-letter file read back,
+// rows are kept as they were written.
+type deadLetterEntry struct {
+	DeadLetter
+	Rows []json.RawMessage `json:"rows"`
+	line []byte
+}
+
+// ReadDeadLetters returns the lines of DeadLetterFile, a missing file gives no lines.
+func (a *App) ReadDeadLetters() ([]*deadLetterEntry, error) {
+	data, err := os.ReadFile(a.Config.DeadLetterFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("os.ReadFile() failed: %v", err)
+	}
+	var list []*deadLetterEntry
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		e := &deadLetterEntry{line: line}
+		if err := json.Unmarshal(line, e); err != nil {
+			return nil, fmt.Errorf("dead-letter line %d: json.Unmarshal() failed: %v", i+1, err)
+		}
+		list = append(list, e)
+	}
+	return list, nil
+}
+
+// RetryDeadLetters sends the checks of DeadLetterFile again, one request per check,
+// delivered checks are removed from the file. Rows which were not formatted
+// (status code 0) can not be sent, they are kept.
+// It returns the numbers of delivered and failed checks.
+func (a *App) RetryDeadLetters(ctx context.Context) (int, int, error) {
+	list, err := a.ReadDeadLetters()
+	if err != nil {
+		return 0, 0, err
+	}
+	sent, failed := 0, 0
+	var rest bytes.Buffer
+	for _, e := range list {
+		send_err := ctx.Err()
+		if send_err == nil && e.StatusCode != 0 {
+			send_err = a.retryDeadLetter(ctx, e)
+		}
+		switch {
+		case e.StatusCode == 0:
+		case send_err == nil:
+			a.Log.Infof("dead letter of check %s delivered", e.CheckId)
+			sent++
+			continue
+		default:
+			a.Log.Errorf("dead letter of check %s failed: %v", e.CheckId, send_err)
+			failed++
+		}
+		rest.Write(e.line)
+		rest.WriteString("\n")
+	}
+	if sent > 0 {
+		if err := writeFileAtomic(a.Config.DeadLetterFile, rest.Bytes()); err != nil {
+			return sent, failed, err
+		}
+	}
+	return sent, failed, nil
+}
+
+// retryDeadLetter sends the rows of the check to its url in one attempt.
+func (a *App) retryDeadLetter(ctx context.Context, e *deadLetterEntry) error {
+	rows := make([]RKRow, len(e.Rows))
+	for i, row := range e.Rows {
+		rows[i] = row
+	}
+	body, batch_key, err := a.encodeBatch(rows, e.Keys)
+	if err != nil {
+		return err
+	}
+	req, err := a.newDataRequest(body, batch_key, e.URL, a.Config.APIKey)
+	if err != nil {
+		return err
+	}
+	return a.doDataRequest(ctx, req)
+}
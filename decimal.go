@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Decimal formats in json.
+const (
+	DECIMAL_FORMAT_NUMBER = "number" // default: 2928.10
+	DECIMAL_FORMAT_STRING = "string" // "2928.10"
+)
+
+var decimalRe = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// Decimal is an exact decimal number kept as text with its original scale,
+// MONEY 2928.1 is "2928.1000". No float conversion is ever done.
+type Decimal struct {
+	text   string
+	quoted bool // marshal as json string
+}
+
+// ParseDecimal validates decimal text: optional minus, digits, optional fraction.
+// If quoted is set, the value is marshaled as json string.
+func ParseDecimal(s string, quoted bool) (Decimal, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "-.") {
+		s = strings.Replace(s, ".", "0.", 1)
+	}
+	if !decimalRe.MatchString(s) {
+		return Decimal{}, fmt.Errorf("invalid decimal value: %q", s)
+	}
+	return Decimal{text: s, quoted: quoted}, nil
+}
+
+// DecimalFromInt returns decimal of integer value.
+func DecimalFromInt(v int64, quoted bool) Decimal {
+	return Decimal{text: strconv.FormatInt(v, 10), quoted: quoted}
+}
+
+// String returns decimal text.
+func (d Decimal) String() string {
+	if d.text == "" {
+		return "0"
+	}
+	return d.text
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	if d.quoted {
+		return []byte(`"` + d.String() + `"`), nil
+	}
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON accepts json number or string.
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	quoted := bytes.HasPrefix(data, []byte(`"`))
+	v, err := ParseDecimal(strings.Trim(string(data), `"`), quoted)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
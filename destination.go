@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Lookup tables of restaurant and cash group names.
+const (
+	LOOKUP_RESTAURANTS = "RESTAURANTS"
+	LOOKUP_CASH_GROUPS = "CASHGROUPS"
+)
+
+var destinationNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// destination is an API receiving data in multi-destination mode.
+// Its App has the configuration of the destination and its own delivery
+// state: checkpoints, outbox, dead letters, page size. Rows are read once
+// by the main App and passed to every destination.
+type destination struct {
+	*App
+	name string
+
+	locations []Location  // checks routed to the destination, location mode only
+	group     *routeGroup // location routing of the destination, nil - not routed
+
+	restaurants map[int64]bool // resolved restaurant filter, nil - all restaurants
+	cashGroups  map[int64]bool // resolved cash group filter, nil - all cash groups
+
+	periodURL, url   string    // report period and send data urls
+	dateFrom, dateTo time.Time // period of the current cycle
+	sent             int       // rows sent in the current cycle
+	err              error     // delivery error, the destination is skipped till the next cycle
+}
+
+// idLookup returns identifiers (SIFR) by names from a lookup table.
+type idLookup func(ctx context.Context, table string) (map[string][]int64, error)
+
+// DestinationConfigFile returns the configuration file name the state files
+// of the destination are named after: CONFIG_NAME.DESTINATION.json
+func DestinationConfigFile(configFile, name string) string {
+	return strings.TrimSuffix(configFile, JSON_EXT) + "." + name + JSON_EXT
+}
+
+// config returns application configuration of the destination:
+// the top level configuration with the parameters set in the destination.
+// State files are not inherited, every destination has its own ones.
+func (d *Destination) config(base *AppConfig) *AppConfig {
+	c := *base
+	c.Destinations = nil
+	c.CheckpointFile, c.DeadLetterFile, c.Outbox.Dir = "", "", ""
+	for _, p := range []struct {
+		v   *string
+		val string
+	}{
+		{&c.APIUrl, d.APIUrl},
+		{&c.APICmdGetPeriod, d.APICmdGetPeriod},
+		{&c.APICmdPutData, d.APICmdPutData},
+		{&c.APIKey, d.APIKey},
+		{&c.ScID, d.ScID},
+		{&c.SaleLocationID, d.SaleLocationID},
+		{&c.Schema, d.Schema},
+		{&c.DecimalFormat, d.DecimalFormat},
+	} {
+		if p.val != "" {
+			*p.v = p.val
+		}
+	}
+	if len(d.Restaurants) > 0 {
+		c.Restaurants = d.Restaurants
+	}
+	if len(d.CashGroups) > 0 {
+		c.CashGroups = d.CashGroups
+	}
+	return &c
+}
+
+// initDestinations creates an App for every destination of the configuration,
+// with locations for every location group of the top level or of a destination
+// (see locationDestinations()). The query filter is the union of destination
+// filters, every destination selects its own rows after the read.
+func (a *App) initDestinations() error {
+	a.destinations = nil
+	a.routeGroups = nil
+	var dests []Destination
+	var locations [][]Location
+	var groups []*routeGroup
+	add_group := func(g *routeGroup, dest Destination, prefix, defName string) error {
+		loc_dests, loc_locations, err := locationDestinations(a.Config, dest, prefix, defName)
+		if err != nil {
+			return err
+		}
+		a.routeGroups = append(a.routeGroups, g)
+		dests = append(dests, loc_dests...)
+		locations = append(locations, loc_locations...)
+		for range loc_dests {
+			groups = append(groups, g)
+		}
+		return nil
+	}
+	if len(a.Config.Locations) > 0 {
+		if len(a.Config.Destinations) > 0 {
+			return fmt.Errorf("top level locations are not supported with destinations, set locations of destinations")
+		}
+		if err := add_group(&routeGroup{}, Destination{Locations: a.Config.Locations}, "", LOCATION_DEFAULT); err != nil {
+			return err
+		}
+	}
+	for i, dest := range a.Config.Destinations {
+		if len(dest.Locations) == 0 {
+			dests = append(dests, dest)
+			locations = append(locations, nil)
+			groups = append(groups, nil)
+			continue
+		}
+		if !destinationNameRe.MatchString(dest.Name) {
+			return fmt.Errorf("destination %d: name %q must consist of letters, digits, - and _", i+1, dest.Name)
+		}
+		if err := add_group(&routeGroup{name: dest.Name}, dest, dest.Name+"_", dest.Name); err != nil {
+			return fmt.Errorf("destination %s: %v", dest.Name, err)
+		}
+	}
+	if len(dests) == 0 {
+		return nil
+	}
+	if a.Config.Stream.Enabled {
+		return fmt.Errorf("stream is not supported with destinations and locations")
+	}
+
+	names := make(map[string]bool)
+	var restaurants, cash_groups []string
+	all_restaurants, all_cash_groups := false, false
+	for i := range dests {
+		dest := &dests[i]
+		if !destinationNameRe.MatchString(dest.Name) {
+			return fmt.Errorf("destination %d: name %q must consist of letters, digits, - and _", i+1, dest.Name)
+		}
+		if names[dest.Name] {
+			return fmt.Errorf("destination %s: duplicate name", dest.Name)
+		}
+		names[dest.Name] = true
+
+		conf := dest.config(a.Config)
+		if err := conf.setFormatDefaults(); err != nil {
+			return fmt.Errorf("destination %s: %v", dest.Name, err)
+		}
+		if err := conf.validateURLs(); err != nil {
+			return fmt.Errorf("destination %s: %v", dest.Name, err)
+		}
+		d_app := &App{
+			Config:     conf,
+			Log:        a.Log,
+			location:   a.location,
+			schedule:   a.schedule,
+			httpClient: a.httpClient,
+			pageSize:   a.pageSize,
+		}
+		d := &destination{App: d_app, name: dest.Name, locations: locations[i], group: groups[i]}
+		if d.group != nil {
+			d.group.members = append(d.group.members, d)
+		}
+		a.destinations = append(a.destinations, d)
+
+		all_restaurants = all_restaurants || len(conf.Restaurants) == 0
+		restaurants = appendNew(restaurants, conf.Restaurants)
+		all_cash_groups = all_cash_groups || len(conf.CashGroups) == 0
+		cash_groups = appendNew(cash_groups, conf.CashGroups)
+	}
+	if all_restaurants {
+		restaurants = nil
+	}
+	if all_cash_groups {
+		cash_groups = nil
+	}
+	a.setSQLFilter(restaurants, cash_groups)
+	return nil
+}
+
+// appendNew appends values missing in list.
+func appendNew(list []string, values []string) []string {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// targets returns the apps delivering data: destinations or the app itself.
+func (a *App) targets() []*App {
+	if len(a.destinations) == 0 {
+		return []*App{a}
+	}
+	apps := make([]*App, len(a.destinations))
+	for i, d := range a.destinations {
+		apps[i] = d.App
+	}
+	return apps
+}
+
+// destinationURLs checks API configuration of every destination.
+func (a *App) destinationURLs() error {
+	for _, d := range a.destinations {
+		var err error
+		if d.periodURL, d.url, err = d.APIUrls(); err != nil {
+			return fmt.Errorf("destination %s: %v", d.name, err)
+		}
+	}
+	return nil
+}
+
+// LookupIDs reads restaurant or cash group identifiers by names.
+func (a *App) LookupIDs(ctx context.Context, table string) (map[string][]int64, error) {
+	if a.db == nil {
+		return nil, fmt.Errorf("MS SQL connection is not opened")
+	}
+	rows, err := a.db.QueryContext(ctx, "SELECT SIFR, NAME FROM "+table)
+	if err != nil {
+		return nil, fmt.Errorf("db.Query() failed: %v", err)
+	}
+	defer rows.Close()
+	ids := make(map[string][]int64)
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		ids[name] = append(ids[name], id)
+	}
+	return ids, rows.Err()
+}
+
+// resolveFilters turns restaurant and cash group names of destinations
+// into identifiers. Names are read on every cycle, so renamed or new
+// restaurants are picked up without restart.
+func (a *App) resolveFilters(ctx context.Context) error {
+	lookups := make(map[string]map[string][]int64)
+	lookup := func(table string) (map[string][]int64, error) {
+		ids, ok := lookups[table]
+		if !ok {
+			var err error
+			if ids, err = a.lookupIDs(ctx, table); err != nil {
+				return nil, fmt.Errorf("LookupIDs() failed: %v", err)
+			}
+			lookups[table] = ids
+		}
+		return ids, nil
+	}
+	resolve := func(d *destination, table string, names []string) (map[int64]bool, error) {
+		if len(names) == 0 {
+			return nil, nil
+		}
+		ids, err := lookup(table)
+		if err != nil {
+			return nil, err
+		}
+		filter := make(map[int64]bool)
+		for _, name := range names {
+			if len(ids[name]) == 0 {
+				a.Log.Warnf("destination %s: %s name not found: %s", d.name, strings.ToLower(table), name)
+			}
+			for _, id := range ids[name] {
+				filter[id] = true
+			}
+		}
+		return filter, nil
+	}
+	for _, d := range a.destinations {
+		var err error
+		if d.restaurants, err = resolve(d, LOOKUP_RESTAURANTS, d.Config.Restaurants); err != nil {
+			return err
+		}
+		if d.cashGroups, err = resolve(d, LOOKUP_CASH_GROUPS, d.Config.CashGroups); err != nil {
+			return err
+		}
+	}
+	if len(a.routeGroups) > 0 {
+		return a.resolveRoutes(lookup)
+	}
+	return nil
+}
+
+// selectRows returns the rows of the destination: its restaurants and cash groups
+// within its period. With locations the rows routed to the destination only.
+// Unformatted rows (RKDate read for all destinations) are formatted in the destination schema,
+// rows which can not be formatted are returned as *rejectedRow with their keys.
+func (d *destination) selectRows(rkData []RKRow, keys []CheckKey) ([]RKRow, []CheckKey, []RKRow, []CheckKey) {
+	rk_data := make([]RKRow, 0, len(rkData))
+	rk_keys := make([]CheckKey, 0, len(keys))
+	var rejected []RKRow
+	var rejected_keys []CheckKey
+	for i, row := range rkData {
+		key := keys[i]
+		if d.group != nil && d.group.page[i] != d {
+			continue
+		}
+		if (d.restaurants != nil && !d.restaurants[key.Restaurant]) || (d.cashGroups != nil && !d.cashGroups[key.CashGroup]) {
+			continue
+		}
+		if !key.CloseTime.IsZero() && !d.dateFrom.IsZero() && (key.CloseTime.Before(d.dateFrom) || key.CloseTime.After(d.dateTo)) {
+			continue
+		}
+		if row_map, ok := row.(RKDate); ok {
+			var err error
+			if row, err = d.formatRow(row_map, key); err != nil {
+				rejected = append(rejected, &rejectedRow{row: row_map, err: err})
+				rejected_keys = append(rejected_keys, key)
+				continue
+			}
+		}
+		rk_data = append(rk_data, row)
+		rk_keys = append(rk_keys, key)
+	}
+	return rk_data, rk_keys, rejected, rejected_keys
+}
+
+// fanOut passes a page to every destination which has not failed in this cycle.
+// Checks delivered before are skipped if skipDelivered is set. Rows the destination
+// can not format are written to its dead-letter file after the page (see rejectRows()).
+// A failed destination is skipped till the next cycle, an error is returned
+// if no destination is left. The next page size is the smallest one of destinations.
+func (a *App) fanOut(ctx context.Context, rkData []RKRow, keys []CheckKey, skipDelivered bool) error {
+	for _, g := range a.routeGroups {
+		g.page = g.page[:0]
+		for _, key := range keys {
+			route := g.route(key)
+			if route == nil {
+				g.unrouted++
+			}
+			g.page = append(g.page, route)
+		}
+	}
+	page_size := 0
+	for _, d := range a.destinations {
+		if d.err != nil {
+			continue
+		}
+		rk_data, rk_keys, rejected, rejected_keys := d.selectRows(rkData, keys)
+		d.batchPeriod = [2]time.Time{d.dateFrom, d.dateTo}
+		url, err := periodURL(d.url, d.dateFrom, d.dateTo)
+		switch {
+		case err != nil, len(rk_data) == 0:
+		case skipDelivered:
+			err = d.deliver(ctx, rk_data, rk_keys, url)
+		default:
+			err = d.sendBatch(ctx, rk_data, rk_keys, url)
+		}
+		if err == nil {
+			err = d.rejectRows(rejected, rejected_keys)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			d.err = err
+			a.Log.Errorf("destination %s: %v, skipped till the next cycle", d.name, err)
+			continue
+		}
+		d.sent += len(rk_data)
+		if page_size == 0 || d.pageSize < page_size {
+			page_size = d.pageSize
+		}
+	}
+	if page_size == 0 {
+		return a.destinationsErr()
+	}
+	a.pageSize = page_size
+	return nil
+}
+
+// failedDestinations returns the number of destinations failed in this cycle.
+func (a *App) failedDestinations() int {
+	cnt := 0
+	for _, d := range a.destinations {
+		if d.err != nil {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// destinationsErr returns the first delivery error of destinations in this cycle.
+func (a *App) destinationsErr() error {
+	for _, d := range a.destinations {
+		if d.err != nil {
+			return fmt.Errorf("destination %s: %w", d.name, d.err)
+		}
+	}
+	return nil
+}
+
+// startDestinations resets the state of the cycle of every destination
+// and returns the page size to read.
+func (a *App) startDestinations(dateFrom, dateTo time.Time) {
+	a.pageSize = 0
+	for _, g := range a.routeGroups {
+		g.unrouted = 0
+	}
+	for _, d := range a.destinations {
+		d.dateFrom, d.dateTo = dateFrom, dateTo
+		d.sent, d.err = 0, nil
+		d.startRun()
+		if a.pageSize == 0 || d.pageSize < a.pageSize {
+			a.pageSize = d.pageSize
+		}
+	}
+}
+
+// logDestinations reports the cycle of every destination.
+func (a *App) logDestinations() {
+	for _, d := range a.destinations {
+		if d.err != nil {
+			a.Log.Errorf("destination %s: sent %d records, failed: %v", d.name, d.sent, d.err)
+		} else {
+			a.Log.Infof("destination %s: sent %d records", d.name, d.sent)
+		}
+		d.logRun()
+	}
+	for _, g := range a.routeGroups {
+		switch {
+		case g.unrouted == 0:
+		case g.name == "":
+			a.Log.Warnf("%d records of restaurants without location are not sent", g.unrouted)
+		default:
+			a.Log.Warnf("destination %s: %d records of restaurants without location are not sent", g.name, g.unrouted)
+		}
+	}
+}
+
+// sendDestinations runs one export cycle of all destinations. The period
+// of every destination is taken from its checkpoints or its API, the rows
+// of the union of periods are read once and passed to every destination.
+func (a *App) sendDestinations(ctx context.Context) error {
+	if err := a.resolveFilters(ctx); err != nil {
+		return err
+	}
+	a.startDestinations(time.Time{}, time.Time{})
+
+	var date_from, date_to time.Time
+	for _, d := range a.destinations {
+		//undelivered batches of previous cycles go first
+		if _, _, err := d.replayOutbox(ctx, false); err != nil && ctx.Err() == nil {
+			a.Log.Errorf("destination %s: replayOutbox() failed: %v", d.name, err)
+		}
+		var err error
+		d.dateFrom, d.dateTo, err = d.ReportPeriod(ctx, d.periodURL, d.Config.APIKey)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			d.err = fmt.Errorf("ReportPeriod() failed: %v", err)
+			a.Log.Errorf("destination %s: %v", d.name, d.err)
+			continue
+		}
+		if date_from.IsZero() || d.dateFrom.Before(date_from) {
+			date_from = d.dateFrom
+		}
+		if d.dateTo.After(date_to) {
+			date_to = d.dateTo
+		}
+	}
+	if date_from.IsZero() {
+		return a.destinationsErr()
+	}
+
+	err := a.exportPeriod(ctx, date_from, date_to, func(rkData []RKRow, keys []CheckKey) error {
+		return a.fanOut(ctx, rkData, keys, true)
+	})
+	a.logDestinations()
+	if err != nil {
+		return err
+	}
+	return a.destinationsErr()
+}
+
+// backfillDestinations sends the day to all destinations, checkpoints do not filter the data.
+// It returns the number of rows read.
+func (a *App) backfillDestinations(ctx context.Context, day time.Time) (int, error) {
+	if err := a.resolveFilters(ctx); err != nil {
+		return 0, err
+	}
+	a.startDestinations(day, endOfDay(day))
+	cnt := 0
+	err := a.exportPeriod(ctx, day, endOfDay(day), func(rkData []RKRow, keys []CheckKey) error {
+		if err := a.fanOut(ctx, rkData, keys, false); err != nil {
+			return err
+		}
+		cnt += len(rkData)
+		return nil
+	})
+	a.logDestinations()
+	if err != nil {
+		return cnt, err
+	}
+	return cnt, a.destinationsErr()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// EXPORT_DATE_TIME_LAYOUT is the layout of export period bounds with time,
+// bounds without time are taken as whole days.
+const EXPORT_DATE_TIME_LAYOUT = "2006-01-02T15:04:05"
+
+// ParseExportPeriod parses period bounds in RKeeper time zone.
+// dateTo without time is the end of the day.
+func (a *App) ParseExportPeriod(dateFrom, dateTo string) (time.Time, time.Time, error) {
+	dt_from, _, err := a.parseExportDate(dateFrom)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid date from: %v", err)
+	}
+	dt_to, with_time, err := a.parseExportDate(dateTo)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid date to: %v", err)
+	}
+	if !with_time {
+		dt_to = endOfDay(dt_to)
+	}
+	if dt_to.Before(dt_from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("date to %s is before date from %s", dateTo, dateFrom)
+	}
+	return dt_from, dt_to, nil
+}
+
+func (a *App) parseExportDate(s string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation(EXPORT_DATE_TIME_LAYOUT, s, a.location); err == nil {
+		return t, true, nil
+	}
+	t, err := time.ParseInLocation(ReportPeriodLoyout, s, a.location)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%q expected in format %s or %s", s, ReportPeriodLoyout, EXPORT_DATE_TIME_LAYOUT)
+	}
+	return t, false, nil
+}
+
+// Export fetches data for the period and writes it to w in the same
+// envelope as it is sent to API. API and checkpoints are not used.
+// It returns the number of rows written.
+func (a *App) Export(ctx context.Context, dateFrom, dateTo time.Time, w io.Writer) (int, error) {
+	if err := a.OpenDB(ctx); err != nil {
+		return 0, err
+	}
+	defer a.CloseDB()
+
+	return a.writePeriod(ctx, dateFrom, dateTo, w)
+}
+
+func (a *App) writePeriod(ctx context.Context, dateFrom, dateTo time.Time, w io.Writer) (int, error) {
+	rk_data := make([]RKRow, 0)
+	if err := a.exportPeriod(ctx, dateFrom, dateTo, func(rkData []RKRow, keys []CheckKey) error {
+		for i, row := range rkData {
+			//rows read for destinations are written in the top level schema
+			if row_map, ok := row.(RKDate); ok && len(a.destinations) > 0 {
+				var err error
+				if row, err = a.formatRow(row_map, keys[i]); err != nil {
+					a.Log.Errorf("row rejected, key: %+v, %v", keys[i], err)
+					continue
+				}
+			}
+			rk_data = append(rk_data, row)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(a.dataEnvelope(rk_data)); err != nil {
+		return 0, fmt.Errorf("json.Encode() failed: %v", err)
+	}
+	return len(rk_data), nil
+}
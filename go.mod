@@ -3,10 +3,13 @@ module github.com/dronm/rkexport
 go 1.21.3
 
 require (
-	github.com/denisenkom/go-mssqldb v0.12.3 // indirect
+	github.com/denisenkom/go-mssqldb v0.12.3
+	github.com/labstack/gommon v0.4.2
+)
+
+require (
 	github.com/golang-sql/civil v0.0.0-20190719163853-cb61b32ac6fe // indirect
 	github.com/golang-sql/sqlexp v0.1.0 // indirect
-	github.com/labstack/gommon v0.4.2 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
@@ -4,15 +4,14 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
-	_ "github.com/denisenkom/go-mssqldb"
+	mssql "github.com/denisenkom/go-mssqldb"
 )
 
 const SQL_FILE_NAME = "msQuery.sql"
@@ -23,11 +22,31 @@ const (
 	DEF_PARAM_COUNT = 100
 )
 
+// MS SQL connection pool defaults.
+const (
+	MS_MAX_OPEN_CONNS        = 2
+	MS_MAX_IDLE_CONNS        = 1
+	MS_CONN_MAX_LIFETIME_MS  = 30 * 60 * 1000
+	MS_CONN_MAX_IDLE_TIME_MS = 5 * 60 * 1000
+	MS_PING_TIMEOUT_MS       = 15 * 1000
+)
+
 // MSSQL query row result
 type RKDate map[string]interface{}
 
+// RKRow is a row of export data: *Check for the check schema,
+// RKDate for the raw schema.
+type RKRow interface{}
+
+// rejectedRow is a row which can not be formatted in the schema.
+// QueryRows() passes it with its key, so pages move past it, the row is not sent.
+type rejectedRow struct {
+	row RKDate
+	err error
+}
+
 // MakeResponse constructs http response from data structure and adds to writer.
-func (a *App) MakeResponse(w http.ResponseWriter, rkData []RKDate) {
+func (a *App) MakeResponse(w http.ResponseWriter, rkData []RKRow) {
 	resp, err := json.Marshal(rkData)
 	if err != nil {
 		a.Log.Errorf("json.Marshal() failed:%v", err)
@@ -43,47 +62,119 @@ func (a *App) MakeResponse(w http.ResponseWriter, rkData []RKDate) {
 	}
 }
 
-// FetchRKData builds ms query and executes it.
-func (a *App) FetchRKData(ctx context.Context, msConStr string, from, count int, dateFrom, dateTo time.Time) ([]RKDate, error) {
-	var rk_data []RKDate
-
-	db, err := sql.Open("sqlserver", msConStr)
+// OpenDB creates MS SQL connection pool from Config.MSCon
+// and checks the connection. The pool is used for the whole run.
+func (a *App) OpenDB(ctx context.Context) error {
+	if a.Config.MSCon == "" {
+		return fmt.Errorf("msCon not set")
+	}
+	db, err := sql.Open("sqlserver", a.Config.MSCon)
 	if err != nil {
-		return rk_data, fmt.Errorf("sql.Open() failed: %v", err)
+		return fmt.Errorf("sql.Open() failed: %v", err)
 	}
-	defer db.Close()
 
-	ctx, cancel := context.WithCancel(ctx)
+	pool := a.Config.MSPool
+	db.SetMaxOpenConns(defInt(pool.MaxOpenConns, MS_MAX_OPEN_CONNS))
+	db.SetMaxIdleConns(defInt(pool.MaxIdleConns, MS_MAX_IDLE_CONNS))
+	db.SetConnMaxLifetime(time.Duration(defInt(pool.ConnMaxLifetime, MS_CONN_MAX_LIFETIME_MS)) * time.Millisecond)
+	db.SetConnMaxIdleTime(time.Duration(defInt(pool.ConnMaxIdleTime, MS_CONN_MAX_IDLE_TIME_MS)) * time.Millisecond)
+
+	ping_ctx, cancel := context.WithTimeout(ctx, time.Duration(defInt(pool.PingTimeout, MS_PING_TIMEOUT_MS))*time.Millisecond)
 	defer cancel()
+	if err := db.PingContext(ping_ctx); err != nil {
+		db.Close()
+		return fmt.Errorf("MS SQL server is not available, db.PingContext() failed: %v", err)
+	}
+	a.db = db
 
-	// if err := db.PingContext(ctx); err != nil {
-	// return rk_data, fmt.Errorf("db.PingContext() failed: %v", err)
-	// }
+	return nil
+}
+
+// CloseDB closes MS SQL connection pool.
+func (a *App) CloseDB() {
+	if a.db == nil {
+		return
+	}
+	if err := a.db.Close(); err != nil {
+		a.Log.Errorf("db.Close() failed: %v", err)
+	}
+	a.db = nil
+}
 
-	q, err := a.QueryText(from, count, dateFrom, dateTo)
+// defInt returns def if v is not set.
+func defInt(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// FetchRKData builds ms query and executes it on the connection pool.
+// It returns row data and check keys, keys[i] belongs to row i.
+// In keyset mode the page starts after the given key, otherwise from row number from.
+func (a *App) FetchRKData(ctx context.Context, from, count int, after CheckKey, dateFrom, dateTo time.Time) ([]RKRow, []CheckKey, error) {
+	rk_data := make([]RKRow, 0)
+	keys := make([]CheckKey, 0)
+	err := a.QueryRows(ctx, from, count, after, dateFrom, dateTo, func(row RKRow, key CheckKey) error {
+		rk_data = append(rk_data, row)
+		keys = append(keys, key)
+		return nil
+	})
+	return rk_data, keys, err
+}
+
+// errStopRows is returned by QueryRows() callback to stop reading rows.
+var errStopRows = errors.New("stop reading rows")
+
+// QueryRows builds ms query, executes it on the connection pool and calls fn
+// for every row with its check key as the row is scanned. A row which
+// can not be formatted is passed as *rejectedRow. If fn returns errStopRows,
+// the rest of rows is not read and nil is returned.
+func (a *App) QueryRows(ctx context.Context, from, count int, after CheckKey, dateFrom, dateTo time.Time, fn func(row RKRow, key CheckKey) error) error {
+	if a.db == nil {
+		return fmt.Errorf("MS SQL connection is not opened")
+	}
+
+	q, args, err := a.QueryText(from, count, after, dateFrom, dateTo)
 	if err != nil {
-		return rk_data, fmt.Errorf("a.QueryText() failed: %v", err)
+		return fmt.Errorf("a.QueryText() failed: %v", err)
 	}
 
-	a.Log.Debugf("FetchRKData(), query: %s\n", q)
+	a.Log.Debugf("QueryRows(), query: %s, args: %v\n", q, args)
 
-	rows, err := db.QueryContext(ctx, q)
+	rows, err := a.db.QueryContext(ctx, q, args...)
 	if err != nil {
-		return rk_data, fmt.Errorf("db.Query() failed: %v", err)
+		return fmt.Errorf("db.Query() failed: %v", err)
 	}
 	defer rows.Close()
 
 	columns, err := rows.Columns()
 	if err != nil {
-		return rk_data, err
+		return err
 	}
 
 	column_types, err := rows.ColumnTypes()
 	if err != nil {
-		return rk_data, err
+		return err
 	}
 
-	rk_data = make([]RKDate, 0)
+	//with destinations rows are formatted by every destination in its schema
+	fan_out := len(a.destinations) > 0
+	raw_schema := a.Config.Schema == SCHEMA_RAW && !fan_out
+	check_schema := a.Config.Schema == SCHEMA_CHECK && !fan_out
+	for _, d := range a.destinations {
+		check_schema = check_schema || d.Config.Schema == SCHEMA_CHECK
+	}
+	if check_schema {
+		if err := ValidateCheckColumns(columns); err != nil {
+			return err
+		}
+	}
+	//without all key columns rows have zero keys: no checkpoints, offset paging only
+	missing_keys := missingKeyColumns(columns)
+	if len(missing_keys) > 0 && a.queryTemplate.Keyset() {
+		return fmt.Errorf("keyset query does not return key columns: %s", strings.Join(missing_keys, ", "))
+	}
 
 	for rows.Next() {
 		values := make([]interface{}, len(columns))
@@ -93,93 +184,247 @@ func (a *App) FetchRKData(ctx context.Context, msConStr string, from, count int,
 		}
 
 		if err := rows.Scan(value_ptrs...); err != nil {
-			return rk_data, err
+			return err
 		}
 
-		row_map := make(map[string]interface{})
-		for i, col := range columns {
-			val := values[i]
+		var key CheckKey
+		if len(missing_keys) == 0 {
+			key = checkKey(columns, values)
+		}
+		if !key.CloseTime.IsZero() {
+			key.CloseTime = localDateTime(key.CloseTime, a.location)
+		}
 
-			// Handle null values
-			if val == nil {
-				row_map[col] = nil
-				continue
+		row_map := make(RKDate)
+		for i, col := range columns {
+			if row_map[col], err = a.columnValue(column_types[i].DatabaseTypeName(), values[i], raw_schema); err != nil {
+				return fmt.Errorf("column %s: %v", col, err)
 			}
-			// a.Log.Debugf("column %d, SQL type: %s", i, column_types[i].DatabaseTypeName())
-			// Handle different types explicitly
-			var converted bool
-			col_type := column_types[i].DatabaseTypeName()
-			switch col_type {
-			case "INT", "BIGINT", "SMALLINT", "TINYINT":
-				if row_map[col], converted = val.(int64); !converted {
-					return rk_data, fmt.Errorf("error converting %s to int64", col_type)
-				}
-			case "FLOAT", "REAL", "DECIMAL", "NUMERIC":
-				if row_map[col], converted = val.(float64); !converted {
-					return rk_data, fmt.Errorf("error converting %s to float64", col_type)
-				}
-			case "MONEY", "SMALLMONEY":
-				var val_b []byte
-				if val_b, converted = val.([]byte); !converted {
-					return rk_data, fmt.Errorf("error converting %s to byte", col_type)
-				}
-				val_f, err := strconv.ParseFloat(string(val_b), 64)
-				if err != nil {
-					return rk_data, fmt.Errorf("error converting %s: strconv.ParseFloat() failed: %v", col_type, err)
-				}
-				row_map[col] = val_f
-			case "BIT":
-				if row_map[col], converted = val.(bool); !converted {
-					return rk_data, fmt.Errorf("error converting %s to bool", col_type)
-				}
-			case "CHAR", "VARCHAR", "TEXT", "NCHAR", "NVARCHAR", "NTEXT":
-				if row_map[col], converted = val.(string); !converted {
-					return rk_data, fmt.Errorf("error converting %s to string", col_type)
-				}
-			case "DATE", "DATETIME", "DATETIME2", "SMALLDATETIME", "TIME", "DATETIMEOFFSET":
-				var val_time time.Time
-				if val_time, converted = val.(time.Time); !converted {
-					return rk_data, fmt.Errorf("error converting %s to time.Time", col_type)
-				} else {
-					row_map[col] = val_time.Format(time.RFC3339)
-				}
-			default:
-				a.Log.Debugf("column %d, unknown SQL type: %s", i, col_type)
-				row_map[col] = fmt.Sprintf("%v", val)
+		}
+		var row RKRow = row_map
+		if !fan_out {
+			if row, err = a.formatRow(row_map, key); err != nil {
+				row = &rejectedRow{row: row_map, err: err}
 			}
-			// a.Log.Debugf("map value: %v", row_map[col])
 		}
-		rk_data = append(rk_data, row_map)
+		if err := fn(row, key); err != nil {
+			if err == errStopRows {
+				return nil
+			}
+			return err
+		}
 	}
 
-	return rk_data, nil
+	return rows.Err()
 }
 
-// QueryText takes query text from file, adds conditions from Config,
-// from, to from http query
-func (a *App) QueryText(from, count int, dateFrom, dateTo time.Time) (string, error) {
-	dir, err := os.Getwd()
+// formatRow maps a scanned row onto the schema: Check or RKDate with CHECK_ID.
+// Datetimes of unformatted rows (read for destinations) are formatted for raw schema,
+// decimals are marshaled in DecimalFormat.
+func (a *App) formatRow(rowMap RKDate, key CheckKey) (RKRow, error) {
+	if a.Config.Schema == SCHEMA_RAW {
+		quoted := a.Config.DecimalFormat == DECIMAL_FORMAT_STRING
+		row := make(RKDate, len(rowMap)+1)
+		for col, val := range rowMap {
+			switch v := val.(type) {
+			case time.Time:
+				row[col] = v.Format(time.RFC3339)
+			case Decimal:
+				v.quoted = quoted
+				row[col] = v
+			default:
+				row[col] = val
+			}
+		}
+		if key != (CheckKey{}) {
+			row[RAW_COL_CHECK_ID] = key.ID()
+		}
+		return row, nil
+	}
+	check, err := NewCheck(rowMap, a.Config.DecimalFormat)
 	if err != nil {
-		return "", fmt.Errorf("os.Getwd() faile: %v", err)
+		return nil, fmt.Errorf("NewCheck() failed: %v", err)
+	}
+	check.CheckId = key.ID()
+	return check, nil
+}
+
+// columnValue converts scanned value by its SQL type.
+// MONEY and DECIMAL values are kept exact as Decimal with their original scale.
+// Datetime values are formatted for raw schema and kept as time.Time otherwise.
+func (a *App) columnValue(colType string, val interface{}, rawSchema bool) (interface{}, error) {
+	// Handle null values
+	if val == nil {
+		return nil, nil
+	}
+	// Handle different types explicitly
+	switch colType {
+	case "INT", "BIGINT", "SMALLINT", "TINYINT":
+		if v, ok := val.(int64); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("error converting %s to int64", colType)
+	case "FLOAT", "REAL":
+		if v, ok := val.(float64); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("error converting %s to float64", colType)
+	case "MONEY", "SMALLMONEY", "DECIMAL", "NUMERIC":
+		val_b, ok := val.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("error converting %s to byte", colType)
+		}
+		val_d, err := ParseDecimal(string(val_b), a.Config.DecimalFormat == DECIMAL_FORMAT_STRING)
+		if err != nil {
+			return nil, fmt.Errorf("error converting %s: ParseDecimal() failed: %v", colType, err)
+		}
+		return val_d, nil
+	case "BIT":
+		if v, ok := val.(bool); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("error converting %s to bool", colType)
+	case "CHAR", "VARCHAR", "TEXT", "NCHAR", "NVARCHAR", "NTEXT":
+		if v, ok := val.(string); ok {
+			return v, nil
+		}
+		return nil, fmt.Errorf("error converting %s to string", colType)
+	case "DATE", "DATETIME", "DATETIME2", "SMALLDATETIME", "TIME", "DATETIMEOFFSET":
+		val_time, ok := val.(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("error converting %s to time.Time", colType)
+		}
+		if colType == "DATETIMEOFFSET" {
+			val_time = val_time.In(a.location)
+		} else {
+			val_time = localDateTime(val_time, a.location)
+		}
+		if rawSchema {
+			return val_time.Format(time.RFC3339), nil
+		}
+		return val_time, nil
+	default:
+		a.Log.Debugf("unknown SQL type: %s", colType)
+		return fmt.Sprintf("%v", val), nil
+	}
+}
+
+// missingKeyColumns returns the key columns not returned by the query.
+func missingKeyColumns(columns []string) []string {
+	col_m := make(map[string]bool, len(columns))
+	for _, col := range columns {
+		col_m[strings.ToUpper(col)] = true
+	}
+	var missing []string
+	for _, col := range []string{KEY_COL_RESTAURANT, KEY_COL_CASH_GROUP, KEY_COL_VISIT, KEY_COL_CHECK_UNI, KEY_COL_CLOSE} {
+		if !col_m[col] {
+			missing = append(missing, col)
+		}
+	}
+	return missing
+}
+
+// checkKey extracts key columns from scanned row values.
+// Missing columns are left with zero values.
+func checkKey(columns []string, values []interface{}) CheckKey {
+	var key CheckKey
+	for i, col := range columns {
+		switch strings.ToUpper(col) {
+		case KEY_COL_RESTAURANT:
+			key.Restaurant, _ = values[i].(int64)
+		case KEY_COL_CASH_GROUP:
+			key.CashGroup, _ = values[i].(int64)
+		case KEY_COL_VISIT:
+			key.Visit, _ = values[i].(int64)
+		case KEY_COL_CHECK_UNI:
+			key.CheckUni, _ = values[i].(int64)
+		case KEY_COL_CLOSE:
+			key.CloseTime, _ = values[i].(time.Time)
+		}
 	}
-	query_b, err := os.ReadFile(filepath.Join(dir, SQL_FILE_NAME))
+	return key
+}
+
+// Query template placeholders, each one is replaced with a named parameter.
+const (
+	QUERY_PARAM_DATE_FROM = "pDateFrom"
+	QUERY_PARAM_DATE_TO   = "pDateTo"
+	QUERY_PARAM_FROM      = "pFrom"
+	QUERY_PARAM_COUNT     = "pCount"
+
+	//keyset mode: last key of the previous page
+	QUERY_PARAM_LAST_CLOSE      = "pLastClose"
+	QUERY_PARAM_LAST_CASH_GROUP = "pLastCashGroup"
+	QUERY_PARAM_LAST_VISIT      = "pLastVisit"
+	QUERY_PARAM_LAST_CHECK_UNI  = "pLastCheckUni"
+)
+
+// QueryText takes query text from the cached template, adds conditions from Config,
+// from, to from http query.
+// It returns query text with named parameters and the list of
+// argumets for db.QueryContext(). No value is spliced into the text.
+// If the template contains {{LAST_CLOSE}}, the query is in keyset mode:
+// {{LAST_CLOSE}}, {{LAST_CASH_GROUP}}, {{LAST_VISIT}}, {{LAST_CHECK_UNI}}
+// are the key of the last row of the previous page, {{FROM}} is not allowed.
+func (a *App) QueryText(from, count int, after CheckKey, dateFrom, dateTo time.Time) (string, []interface{}, error) {
+	if a.queryTemplate == nil {
+		return "", nil, fmt.Errorf("query template is not loaded")
+	}
+	query_t, keyset, err := a.queryTemplate.Text()
 	if err != nil {
-		return "", fmt.Errorf("os.ReadFile() failed: %v", err)
+		//previous version of the template is used
+		a.Log.Errorf("query template reload failed: %v", err)
 	}
 
-	//
-	query_t := string(query_b)
-	query_t = strings.Replace(query_t, "{{COUNT}}", fmt.Sprintf("%d", count), 1)
-	query_t = strings.Replace(query_t, "{{FROM}}", fmt.Sprintf("%d", from), 1)
-	query_t = strings.Replace(query_t, "{{DATE_FROM}}", fmt.Sprintf("'%s'", dateFrom.Format(PARAM_DATE_LAYOUT)), 1)
-	query_t = strings.Replace(query_t, "{{DATE_TO}}", fmt.Sprintf("'%s'", dateTo.Format(PARAM_DATE_LAYOUT)), 1)
+	query_t = strings.ReplaceAll(query_t, PH_COUNT, "@"+QUERY_PARAM_COUNT)
+	query_t = strings.ReplaceAll(query_t, PH_DATE_FROM, "@"+QUERY_PARAM_DATE_FROM)
+	query_t = strings.ReplaceAll(query_t, PH_DATE_TO, "@"+QUERY_PARAM_DATE_TO)
+
+	//DATETIME columns are compared with DATETIME parameters
+	args := []interface{}{
+		sql.Named(QUERY_PARAM_COUNT, count),
+		sql.Named(QUERY_PARAM_DATE_FROM, msDateTime(dateFrom.In(a.location))),
+		sql.Named(QUERY_PARAM_DATE_TO, msDateTime(dateTo.In(a.location))),
+	}
+	if keyset {
+		query_t = strings.ReplaceAll(query_t, PH_LAST_CLOSE, "@"+QUERY_PARAM_LAST_CLOSE)
+		query_t = strings.ReplaceAll(query_t, PH_LAST_CASH_GROUP, "@"+QUERY_PARAM_LAST_CASH_GROUP)
+		query_t = strings.ReplaceAll(query_t, PH_LAST_VISIT, "@"+QUERY_PARAM_LAST_VISIT)
+		query_t = strings.ReplaceAll(query_t, PH_LAST_CHECK_UNI, "@"+QUERY_PARAM_LAST_CHECK_UNI)
+		args = append(args,
+			sql.Named(QUERY_PARAM_LAST_CLOSE, msDateTime(after.CloseTime.In(a.location))),
+			sql.Named(QUERY_PARAM_LAST_CASH_GROUP, after.CashGroup),
+			sql.Named(QUERY_PARAM_LAST_VISIT, after.Visit),
+			sql.Named(QUERY_PARAM_LAST_CHECK_UNI, after.CheckUni),
+		)
+	} else {
+		query_t = strings.ReplaceAll(query_t, PH_FROM, "@"+QUERY_PARAM_FROM)
+		args = append(args, sql.Named(QUERY_PARAM_FROM, from))
+	}
 
 	//extra conditions
 	cond := ""
 	if a.sqlFilter != "" {
 		cond = " AND " + a.sqlFilter
+		args = append(args, a.sqlFilterArgs...)
 	}
-	query_t = strings.Replace(query_t, "{{FILTER}}", cond, 1)
+	query_t = strings.ReplaceAll(query_t, PH_FILTER, cond)
+
+	return query_t, args, nil
+}
+
+// localDateTime returns the wall clock of scanned DATETIME value in loc.
+// The driver returns DATETIME values without zone as UTC.
+func localDateTime(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
 
-	return query_t, nil
+// msDateTime converts t to DATETIME parameter, the wall clock of t is used.
+// DATETIME is stored in ticks of 1/300 second, scanned values are rounded
+// to milliseconds while the driver truncates nanoseconds to ticks on encoding,
+// so t is moved to the tick boundary to get exactly the same DATETIME back.
+func msDateTime(t time.Time) mssql.DateTime1 {
+	tick := int64(math.Round(float64(t.Nanosecond()) * 300 / 1e9))
+	ns := (tick*1e9 + 299) / 300
+	return mssql.DateTime1(t.Truncate(time.Second).Add(time.Duration(ns)))
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// LOCATION_DEFAULT is the destination of the checks of restaurants without location
+// of the top level locations.
+const LOCATION_DEFAULT = "default"
+
+var locationNameRe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// routeKey is a restaurant and a cash group of the routing table, cash group 0 - all cash groups.
+type routeKey struct {
+	restaurant, cashGroup int64
+}
+
+// routeGroup routes every check to one of the destinations created for the locations
+// of the top level configuration or of a destination.
+type routeGroup struct {
+	name         string // destination of the locations, "" - top level locations
+	members      []*destination
+	routes       map[routeKey]*destination
+	defaultRoute *destination   // destination of checks without location
+	page         []*destination // destinations of the rows of the current page
+	unrouted     int            // rows without location in the current cycle
+}
+
+// locationName returns the destination name of the location: SCID-SALELOCATIONID
+// with characters not allowed in names replaced by _.
+func locationName(scID, saleLocationID string) string {
+	return locationNameRe.ReplaceAllString(scID+"-"+saleLocationID, "_")
+}
+
+// locationDestinations groups the locations of dest by scID and saleLocationID,
+// every group is a copy of dest named prefix + SCID-SALELOCATIONID. The checks
+// of restaurants without location are sent to dest itself named defName
+// if its scID and saleLocationID (or the top level ones) are set.
+func locationDestinations(c *AppConfig, dest Destination, prefix, defName string) ([]Destination, [][]Location, error) {
+	def_sc_id, def_location_id := dest.ScID, dest.SaleLocationID
+	if def_sc_id == "" {
+		def_sc_id = c.ScID
+	}
+	if def_location_id == "" {
+		def_location_id = c.SaleLocationID
+	}
+	var dests []Destination
+	var locations [][]Location
+	names := make(map[string]int)
+	for i, loc := range dest.Locations {
+		if loc.Restaurant == "" && loc.RestaurantID == 0 {
+			return nil, nil, fmt.Errorf("location %d: restaurant or restaurantId not set", i+1)
+		}
+		if loc.SaleLocationID == "" {
+			return nil, nil, fmt.Errorf("location %d: saleLocationID not set", i+1)
+		}
+		sc_id := loc.ScID
+		if sc_id == "" {
+			sc_id = def_sc_id
+		}
+		if sc_id == "" {
+			return nil, nil, fmt.Errorf("location %d: scID not set", i+1)
+		}
+		name := prefix + locationName(sc_id, loc.SaleLocationID)
+		ind, ok := names[name]
+		if !ok {
+			ind = len(dests)
+			names[name] = ind
+			loc_dest := dest
+			loc_dest.Name, loc_dest.ScID, loc_dest.SaleLocationID, loc_dest.Locations = name, sc_id, loc.SaleLocationID, nil
+			dests = append(dests, loc_dest)
+			locations = append(locations, nil)
+		} else if dests[ind].ScID != sc_id || dests[ind].SaleLocationID != loc.SaleLocationID {
+			return nil, nil, fmt.Errorf("location %d: scID %s, saleLocationID %s and scID %s, saleLocationID %s have the same name %s",
+				i+1, sc_id, loc.SaleLocationID, dests[ind].ScID, dests[ind].SaleLocationID, name)
+		}
+		locations[ind] = append(locations[ind], loc)
+	}
+	if def_sc_id != "" && def_location_id != "" {
+		def_dest := dest
+		def_dest.Name, def_dest.Locations = defName, nil
+		dests = append(dests, def_dest)
+		locations = append(locations, nil)
+	}
+	return dests, locations, nil
+}
+
+// locationIDs returns the identifier if it is set or the identifiers of the name.
+func locationIDs(lookup func(table string) (map[string][]int64, error), table string, id int64, name string) ([]int64, error) {
+	if id != 0 {
+		return []int64{id}, nil
+	}
+	ids, err := lookup(table)
+	if err != nil {
+		return nil, err
+	}
+	return ids[name], nil
+}
+
+// resolveRoutes builds the routing table of every group: restaurant and cash group
+// identifiers to the destination of their location. A restaurant and a cash group
+// routed to different locations of a group is a configuration error.
+func (a *App) resolveRoutes(lookup func(table string) (map[string][]int64, error)) error {
+	for _, g := range a.routeGroups {
+		g.routes = make(map[routeKey]*destination)
+		g.defaultRoute = nil
+		for _, d := range g.members {
+			if len(d.locations) == 0 {
+				g.defaultRoute = d
+				continue
+			}
+			for _, loc := range d.locations {
+				restaurants, err := locationIDs(lookup, LOOKUP_RESTAURANTS, loc.RestaurantID, loc.Restaurant)
+				if err != nil {
+					return err
+				}
+				cash_groups := []int64{0}
+				if loc.CashGroupID != 0 || loc.CashGroup != "" {
+					if cash_groups, err = locationIDs(lookup, LOOKUP_CASH_GROUPS, loc.CashGroupID, loc.CashGroup); err != nil {
+						return err
+					}
+				}
+				if len(restaurants) == 0 || len(cash_groups) == 0 {
+					a.Log.Warnf("location %s: restaurant %q or cash group %q not found", d.name, loc.Restaurant, loc.CashGroup)
+					continue
+				}
+				for _, restaurant := range restaurants {
+					for _, cash_group := range cash_groups {
+						key := routeKey{restaurant: restaurant, cashGroup: cash_group}
+						if other, ok := g.routes[key]; ok && other != d {
+							return fmt.Errorf("restaurant %d, cash group %d routed to locations %s and %s",
+								restaurant, cash_group, other.name, d.name)
+						}
+						g.routes[key] = d
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// route returns the destination of the check: the location of its restaurant
+// and cash group, of its restaurant or the default one. nil - the check is not sent.
+func (g *routeGroup) route(key CheckKey) *destination {
+	if d, ok := g.routes[routeKey{restaurant: key.Restaurant, cashGroup: key.CashGroup}]; ok {
+		return d
+	}
+	if d, ok := g.routes[routeKey{restaurant: key.Restaurant}]; ok {
+		return d
+	}
+	return g.defaultRoute
+}
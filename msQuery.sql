@@ -1,9 +1,10 @@
 SELECT 
 	RESTAURANTS.SIFR AS RESTAURANTID,
-	CASHGROUPS.SIFR AS CASHGROUPID,
-	VISITS.SIFR AS VISITID,
+	PRINTCHECKS.MIDSERVER AS CASHGROUPID,
+	PRINTCHECKS.VISIT AS VISITID,
 	PRINTCHECKS.STARTDATETIME AS CHECKOPEN,
 	PRINTCHECKS.CLOSEDATETIME AS CHECKCLOSE,
+	PRINTCHECKS.UNI AS CHECKUNI,
 	VISITS.STARTTIME AS VISITSTARTTIME,
 	PRINTCHECKS.PRINTNUMBER AS ORDERNUM,
 	PRINTCHECKS.FISCDOCNUMBER AS FISCDOCNUM,
@@ -34,19 +35,26 @@ LEFT JOIN (
 WHERE 
 	PRINTCHECKS.CLOSEDATETIME BETWEEN {{DATE_FROM}} AND {{DATE_TO}}
 	AND PAYBINDINGS.STATE = 6
+	AND (
+		PRINTCHECKS.CLOSEDATETIME > {{LAST_CLOSE}}
+		OR (PRINTCHECKS.CLOSEDATETIME = {{LAST_CLOSE}} AND PRINTCHECKS.MIDSERVER > {{LAST_CASH_GROUP}})
+		OR (PRINTCHECKS.CLOSEDATETIME = {{LAST_CLOSE}} AND PRINTCHECKS.MIDSERVER = {{LAST_CASH_GROUP}} AND PRINTCHECKS.VISIT > {{LAST_VISIT}})
+		OR (PRINTCHECKS.CLOSEDATETIME = {{LAST_CLOSE}} AND PRINTCHECKS.MIDSERVER = {{LAST_CASH_GROUP}} AND PRINTCHECKS.VISIT = {{LAST_VISIT}} AND PRINTCHECKS.UNI > {{LAST_CHECK_UNI}})
+	)
 {{FILTER}}
 GROUP BY
 	RESTAURANTS.SIFR,
-	CASHGROUPS.SIFR,
-	VISITS.SIFR,
+	PRINTCHECKS.MIDSERVER,
+	PRINTCHECKS.VISIT,
 	PRINTCHECKS.STARTDATETIME,
 	PRINTCHECKS.CLOSEDATETIME,
+	PRINTCHECKS.UNI,
 	VISITS.STARTTIME,
 	PRINTCHECKS.PRINTNUMBER,
 	PRINTCHECKS.FISCDOCNUMBER,
 	ORDERS.PRICELISTSUM,
 	ORDERS.TOTALDISHPIECES,
 	PAYM.PAYLINETYPE
-ORDER BY PRINTCHECKS.CLOSEDATETIME ASC
-OFFSET {{FROM}} ROWS
+ORDER BY PRINTCHECKS.CLOSEDATETIME, PRINTCHECKS.MIDSERVER, PRINTCHECKS.VISIT, PRINTCHECKS.UNI
+OFFSET 0 ROWS
 FETCH NEXT {{COUNT}} ROWS ONLY
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Outbox defaults.
+const (
+	OUTBOX_EXT = ".outbox"
+
+	DEF_OUTBOX_RETRY_INTERVAL = 5 * 60 * 1000 // milliseconds
+	DEF_OUTBOX_MAX_BATCHES    = 1000
+	DEF_OUTBOX_MAX_AGE_DAYS   = 7
+
+	OUTBOX_ID_LAYOUT = "20060102T150405.000000000"
+)
+
+// errBatchParked is returned by sendBatch() for a batch written to the outbox.
+var errBatchParked = errors.New("batch is written to outbox")
+
+// OutboxBatch is an undelivered batch kept in the outbox till it is delivered or purged.
+type OutboxBatch struct {
+	ID             string          `json:"id"` // file name without extension, batches are replayed in ID order
+	Created        time.Time       `json:"created"`
+	URL            string          `json:"url"`
+	IdempotencyKey string          `json:"idempotencyKey"`
+	Rows           int             `json:"rows"`
+	Keys           []CheckKey      `json:"keys"`
+	Attempts       int             `json:"attempts"` // replay attempts
+	LastAttempt    time.Time       `json:"lastAttempt,omitempty"`
+	LastError      string          `json:"lastError"`
+	Body           json.RawMessage `json:"body"` // request body as it was sent
+}
+
+// OutboxStore keeps undelivered batches, one json file per batch
+// in a directory next to the configuration file.
+type OutboxStore struct {
+	dir string
+}
+
+// OutboxDirName returns default outbox directory for the configuration file.
+func OutboxDirName(configFile string) string {
+	return strings.TrimSuffix(configFile, JSON_EXT) + OUTBOX_EXT
+}
+
+// OpenOutboxStore creates the outbox directory if it does not exist.
+func OpenOutboxStore(dir string) (*OutboxStore, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("os.MkdirAll() failed: %v", err)
+	}
+	return &OutboxStore{dir: dir}, nil
+}
+
+func (o *OutboxStore) fileName(id string) string {
+	return filepath.Join(o.dir, id+JSON_EXT)
+}
+
+// Put writes the batch atomically (see writeFileAtomic()).
+func (o *OutboxStore) Put(b *OutboxBatch) error {
+	data, err := json.MarshalIndent(b, "", "\t")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent() failed: %v", err)
+	}
+	return writeFileAtomic(o.fileName(b.ID), data)
+}
+
+// List returns all batches, the oldest first.
+func (o *OutboxStore) List() ([]*OutboxBatch, error) {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadDir() failed: %v", err)
+	}
+	var list []*OutboxBatch
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), JSON_EXT)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		b, err := o.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// Get reads the batch with the given ID.
+func (o *OutboxStore) Get(id string) (*OutboxBatch, error) {
+	data, err := os.ReadFile(o.fileName(id))
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile() failed: %v", err)
+	}
+	b := &OutboxBatch{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("outbox batch %s: json.Unmarshal() failed: %v", id, err)
+	}
+	b.ID = id
+	return b, nil
+}
+
+// Remove deletes the batch.
+func (o *OutboxStore) Remove(id string) error {
+	if err := os.Remove(o.fileName(id)); err != nil {
+		return fmt.Errorf("os.Remove() failed: %v", err)
+	}
+	return nil
+}
+
+// OpenOutbox opens outbox store in dir.
+func (a *App) OpenOutbox(dir string) error {
+	o, err := OpenOutboxStore(dir)
+	if err != nil {
+		return fmt.Errorf("OpenOutboxStore() failed: %v", err)
+	}
+	a.outbox = o
+	return nil
+}
+
+// parkBatch writes a batch failed after all retries to the outbox.
+func (a *App) parkBatch(rkData []RKRow, keys []CheckKey, url string, sendErr error) error {
+	body, batch_key, err := a.encodeBatch(rkData, keys)
+	if err != nil {
+		return err
+	}
+	created := time.Now()
+	b := &OutboxBatch{
+		ID:             created.UTC().Format(OUTBOX_ID_LAYOUT) + "-" + batch_key[:min(len(batch_key), 16)],
+		Created:        created,
+		URL:            url,
+		IdempotencyKey: batch_key,
+		Rows:           len(rkData),
+		Keys:           keys,
+		LastError:      sendErr.Error(),
+		Body:           body,
+	}
+	if err := a.outbox.Put(b); err != nil {
+		return err
+	}
+	a.Log.Warnf("batch of %d records is written to outbox: %s", b.Rows, b.ID)
+	a.checkOutbox()
+	return nil
+}
+
+// replayOutbox sends batches of the outbox, the oldest first, one attempt per batch.
+// Delivered batches are removed. Replay stops on the first failure
+// which is not specific to the batch (API is unavailable).
+// If all is set, every batch is tried regardless of failures.
+// It returns the numbers of delivered and failed batches.
+func (a *App) replayOutbox(ctx context.Context, all bool) (int, int, error) {
+	if a.outbox == nil {
+		return 0, 0, nil
+	}
+	list, err := a.outbox.List()
+	if err != nil {
+		return 0, 0, err
+	}
+	sent, failed := 0, 0
+	for _, b := range list {
+		if err := ctx.Err(); err != nil {
+			return sent, failed, err
+		}
+		err := a.replayBatch(ctx, b)
+		if err == nil {
+			sent++
+			continue
+		}
+		failed++
+		a.Log.Errorf("outbox batch %s failed, attempt %d: %v", b.ID, b.Attempts, err)
+		if !all && retryable(err) {
+			break
+		}
+	}
+	if len(list) > 0 {
+		a.Log.Infof("outbox replay: %d delivered, %d failed, %d left", sent, failed, len(list)-sent)
+	}
+	a.checkOutbox()
+	return sent, failed, nil
+}
+
+// replayBatch sends the batch as it was sent the first time, with the same idempotency key.
+func (a *App) replayBatch(ctx context.Context, b *OutboxBatch) error {
+	req, err := a.newDataRequest(b.Body, b.IdempotencyKey, b.URL, a.Config.APIKey)
+	if err != nil {
+		return err
+	}
+	send_err := a.doDataRequest(ctx, req)
+	if send_err == nil {
+		a.Log.Infof("outbox batch %s of %d records delivered", b.ID, b.Rows)
+		return a.outbox.Remove(b.ID)
+	}
+	b.Attempts++
+	b.LastAttempt = time.Now()
+	b.LastError = send_err.Error()
+	if err := a.outbox.Put(b); err != nil {
+		a.Log.Errorf("outbox.Put() failed: %v", err)
+	}
+	return send_err
+}
+
+// checkOutbox logs an error if the outbox exceeds Outbox.MaxBatches
+// or its oldest batch is older than Outbox.MaxAgeDays.
+func (a *App) checkOutbox() {
+	if a.outbox == nil {
+		return
+	}
+	list, err := a.outbox.List()
+	if err != nil {
+		a.Log.Errorf("outbox.List() failed: %v", err)
+		return
+	}
+	if max_cnt := defInt(a.Config.Outbox.MaxBatches, DEF_OUTBOX_MAX_BATCHES); len(list) > max_cnt {
+		a.Log.Errorf("outbox limit exceeded: %d batches, maximum is %d", len(list), max_cnt)
+	}
+	max_age := defInt(a.Config.Outbox.MaxAgeDays, DEF_OUTBOX_MAX_AGE_DAYS)
+	if len(list) > 0 && time.Since(list[0].Created) > time.Duration(max_age)*24*time.Hour {
+		a.Log.Errorf("outbox limit exceeded: batch %s created %s is older than %d days",
+			list[0].ID, list[0].Created.Format(time.RFC3339), max_age)
+	}
+}
+
+// waitUntil sleeps till dt. If an outbox (of the app or of a destination)
+// is not empty, its batches are replayed every Outbox.RetryInterval meanwhile.
+func (a *App) waitUntil(ctx context.Context, dt time.Time) error {
+	interval := time.Duration(defInt(a.Config.Outbox.RetryInterval, DEF_OUTBOX_RETRY_INTERVAL)) * time.Millisecond
+	for {
+		dur := time.Until(dt)
+		var pending []*App
+		for _, t := range a.targets() {
+			if t.outbox == nil {
+				continue
+			}
+			if list, err := t.outbox.List(); err == nil && len(list) > 0 {
+				pending = append(pending, t)
+			}
+		}
+		if len(pending) == 0 || dur <= interval {
+			return sleepContext(ctx, dur)
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return err
+		}
+		for _, t := range pending {
+			if _, _, err := t.replayOutbox(ctx, false); err != nil && ctx.Err() == nil {
+				a.Log.Errorf("replayOutbox() failed: %v", err)
+			}
+		}
+	}
+}
+
+// RetryOutbox replays the batch with the given ID or all batches if id is empty.
+// It returns the numbers of delivered and failed batches.
+func (a *App) RetryOutbox(ctx context.Context, id string) (int, int, error) {
+	if id == "" {
+		return a.replayOutbox(ctx, true)
+	}
+	b, err := a.outbox.Get(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := a.replayBatch(ctx, b); err != nil {
+		a.Log.Errorf("outbox batch %s failed, attempt %d: %v", b.ID, b.Attempts, err)
+		return 0, 1, nil
+	}
+	return 1, 0, nil
+}
+
+// PurgeOutbox removes the batch with the given ID or all batches if id is empty.
+// Purged data is not delivered, it can be sent again with backfill.
+// It returns the number of removed batches.
+func (a *App) PurgeOutbox(id string) (int, error) {
+	if id != "" {
+		if err := a.outbox.Remove(id); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	list, err := a.outbox.List()
+	if err != nil {
+		return 0, err
+	}
+	for i, b := range list {
+		if err := a.outbox.Remove(b.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(list), nil
+}
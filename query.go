@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Query template placeholders.
+const (
+	PH_DATE_FROM       = "{{DATE_FROM}}"
+	PH_DATE_TO         = "{{DATE_TO}}"
+	PH_FILTER          = "{{FILTER}}"
+	PH_FROM            = "{{FROM}}"
+	PH_COUNT           = "{{COUNT}}"
+	PH_LAST_CLOSE      = "{{LAST_CLOSE}}"
+	PH_LAST_CASH_GROUP = "{{LAST_CASH_GROUP}}"
+	PH_LAST_VISIT      = "{{LAST_VISIT}}"
+	PH_LAST_CHECK_UNI  = "{{LAST_CHECK_UNI}}"
+)
+
+var (
+	queryPlaceholderRe = regexp.MustCompile(`{{[^{}]*}}`)
+
+	queryRequiredPlaceholders = []string{PH_DATE_FROM, PH_DATE_TO, PH_FILTER, PH_COUNT}
+	queryKeysetPlaceholders   = []string{PH_LAST_CLOSE, PH_LAST_CASH_GROUP, PH_LAST_VISIT, PH_LAST_CHECK_UNI}
+)
+
+// QueryTemplate is the cached content of the query template file.
+// The file is read again by Text() when its modification time or size changes.
+type QueryTemplate struct {
+	fileName string
+	mx       sync.Mutex
+	text     string
+	keyset   bool
+	modTime  time.Time
+	size     int64
+}
+
+// QueryFileName returns full name of the query template file.
+// Relative names are taken from the directory of the executable.
+// If the name is not set, SQL_FILE_NAME is searched in the directory of the executable
+// and then in the working directory.
+func QueryFileName(fileName string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("os.Executable() failed: %v", err)
+	}
+	exe_dir := filepath.Dir(exe)
+	if fileName != "" {
+		if filepath.IsAbs(fileName) {
+			return fileName, nil
+		}
+		return filepath.Join(exe_dir, fileName), nil
+	}
+
+	file_name := filepath.Join(exe_dir, SQL_FILE_NAME)
+	if _, err := os.Stat(file_name); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return file_name, nil
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("os.Getwd() failed: %v", err)
+	}
+	return filepath.Join(dir, SQL_FILE_NAME), nil
+}
+
+// LoadQueryTemplate reads and validates query template file.
+func LoadQueryTemplate(fileName string) (*QueryTemplate, error) {
+	q := &QueryTemplate{fileName: fileName}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *QueryTemplate) load() error {
+	info, err := os.Stat(q.fileName)
+	if err != nil {
+		return fmt.Errorf("os.Stat() failed: %v", err)
+	}
+	query_b, err := os.ReadFile(q.fileName)
+	if err != nil {
+		return fmt.Errorf("os.ReadFile() failed: %v", err)
+	}
+	text := string(query_b)
+	keyset, err := ValidateQueryTemplate(text)
+	if err != nil {
+		return fmt.Errorf("query template %s: %v", q.fileName, err)
+	}
+	q.text = text
+	q.keyset = keyset
+	q.modTime = info.ModTime()
+	q.size = info.Size()
+	return nil
+}
+
+// Text returns template text and keyset mode flag.
+// If the file has changed on disk, it is loaded again. A changed file
+// which fails validation is reported with an error and the previous text is kept.
+func (q *QueryTemplate) Text() (string, bool, error) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	var reload_err error
+	info, err := os.Stat(q.fileName)
+	if err != nil {
+		reload_err = fmt.Errorf("os.Stat() failed: %v", err)
+	} else if !info.ModTime().Equal(q.modTime) || info.Size() != q.size {
+		reload_err = q.load()
+	}
+	return q.text, q.keyset, reload_err
+}
+
+// Keyset returns true if the template is in keyset mode.
+func (q *QueryTemplate) Keyset() bool {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	return q.keyset
+}
+
+// ValidateQueryTemplate checks that all required placeholders are present
+// and there are no unknown ones. It returns true for keyset mode templates.
+func ValidateQueryTemplate(text string) (bool, error) {
+	known := map[string]bool{PH_FROM: true}
+	for _, ph := range append(queryRequiredPlaceholders, queryKeysetPlaceholders...) {
+		known[ph] = true
+	}
+
+	var unknown []string
+	for _, ph := range queryPlaceholderRe.FindAllString(text, -1) {
+		if !known[ph] {
+			unknown = append(unknown, ph)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return false, fmt.Errorf("unknown placeholders: %s", strings.Join(unknown, ", "))
+	}
+
+	var missing []string
+	for _, ph := range queryRequiredPlaceholders {
+		if !strings.Contains(text, ph) {
+			missing = append(missing, ph)
+		}
+	}
+
+	keyset := false
+	for _, ph := range queryKeysetPlaceholders {
+		keyset = keyset || strings.Contains(text, ph)
+	}
+	if keyset {
+		if strings.Contains(text, PH_FROM) {
+			return false, fmt.Errorf("%s is not allowed in keyset mode", PH_FROM)
+		}
+		for _, ph := range queryKeysetPlaceholders {
+			if !strings.Contains(text, ph) {
+				missing = append(missing, ph)
+			}
+		}
+	} else if !strings.Contains(text, PH_FROM) {
+		missing = append(missing, PH_FROM+" or "+PH_LAST_CLOSE)
+	}
+	if len(missing) > 0 {
+		return false, fmt.Errorf("missing placeholders: %s", strings.Join(missing, ", "))
+	}
+
+	return keyset, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retry policy defaults, delays are in milliseconds.
+const (
+	DEF_RETRY_MAX_ATTEMPTS  = 5
+	DEF_RETRY_INITIAL_DELAY = 3000
+	DEF_RETRY_MAX_DELAY     = 60000
+	DEF_RETRY_MULTIPLIER    = 2.0
+	DEF_RETRY_JITTER        = 0.2
+	DEF_RETRY_DEADLINE      = 5 * 60000
+
+	API_ERROR_BODY_MAX = 4096 // response body kept in APIError
+)
+
+// setDefaults fills zero values with defaults and validates the policy.
+func (p *RetryPolicy) setDefaults() error {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = DEF_RETRY_MAX_ATTEMPTS
+	}
+	if p.InitialDelay == 0 {
+		p.InitialDelay = DEF_RETRY_INITIAL_DELAY
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = DEF_RETRY_MAX_DELAY
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = DEF_RETRY_MULTIPLIER
+	}
+	if p.Jitter == nil {
+		jitter := DEF_RETRY_JITTER
+		p.Jitter = &jitter
+	}
+	if p.Deadline == 0 {
+		p.Deadline = DEF_RETRY_DEADLINE
+	}
+	switch {
+	case p.MaxAttempts < 1:
+		return fmt.Errorf("retry maxAttempts must be positive")
+	case p.InitialDelay < 0 || p.MaxDelay < 0 || p.Deadline < 0:
+		return fmt.Errorf("retry delays must not be negative")
+	case p.Multiplier < 1:
+		return fmt.Errorf("retry multiplier must not be less than 1")
+	case *p.Jitter < 0 || *p.Jitter > 1:
+		return fmt.Errorf("retry jitter must be in range 0..1")
+	}
+	return nil
+}
+
+// delay returns the pause after the failed attempt (1 based):
+// InitialDelay*Multiplier^(attempt-1) limited by MaxDelay, deviated randomly by Jitter.
+// Retry-After of API response is used if it is longer.
+func (p *RetryPolicy) delay(attempt int, err error) time.Duration {
+	d := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter != nil {
+		d += d * *p.Jitter * (2*rand.Float64() - 1)
+	}
+	delay := time.Duration(d * float64(time.Millisecond))
+
+	var api_err *APIError
+	if errors.As(err, &api_err) && api_err.RetryAfter > delay {
+		delay = api_err.RetryAfter
+	}
+	return delay
+}
+
+// APIError is an API response with unexpected status code.
+type APIError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // Retry-After header, 0 if not set
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API response status code: %d, body: %s", e.StatusCode, e.Body)
+}
+
+// newAPIError reads the beginning of response body and Retry-After header.
+func newAPIError(resp *http.Response) *APIError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, API_ERROR_BODY_MAX))
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Body:       apiErrorBody(body),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// apiErrorBody returns response body for error messages, long bodies are cut.
+func apiErrorBody(body []byte) string {
+	if len(body) > API_ERROR_BODY_MAX {
+		return string(body[:API_ERROR_BODY_MAX]) + "..."
+	}
+	return string(body)
+}
+
+// parseRetryAfter parses Retry-After header value: seconds or HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(value); err == nil {
+		if sec < 0 {
+			return 0
+		}
+		return time.Duration(sec) * time.Second
+	}
+	if dt, err := http.ParseTime(value); err == nil && dt.After(now) {
+		return dt.Sub(now)
+	}
+	return 0
+}
+
+// permanentError is an error which is not retried.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// retryable returns false for errors which will not go away on the next attempt:
+// API statuses other than 408, 429 and 5xx (400, 401, 422...) and permanent errors.
+// Network errors and other failures are retried.
+func retryable(err error) bool {
+	var api_err *APIError
+	if errors.As(err, &api_err) {
+		s := api_err.StatusCode
+		return s == http.StatusRequestTimeout || s == http.StatusTooManyRequests || s >= 500
+	}
+	var perm_err *permanentError
+	return !errors.As(err, &perm_err)
+}
+
+// retry calls attempt till it succeeds, fails with not retryable error
+// or the retry policy is exhausted. op is the operation name for the log.
+func (a *App) retry(ctx context.Context, op string, attempt func() error) error {
+	p := &a.Config.Retry
+	start := time.Now()
+	for n := 1; ; n++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := attempt()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if !retryable(err) {
+			return fmt.Errorf("%s failed, not retryable: %w", op, err)
+		}
+		if n >= p.MaxAttempts {
+			return fmt.Errorf("%s failed after %d attempts: %w", op, n, err)
+		}
+		delay := p.delay(n, err)
+		if p.Deadline > 0 && time.Since(start)+delay > time.Duration(p.Deadline)*time.Millisecond {
+			return fmt.Errorf("%s failed after %d attempts, retry deadline exceeded: %w", op, n, err)
+		}
+		a.Log.Errorf("%s attempt %d failed: %v, next attempt in %v", op, n, err, delay)
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
@@ -1,41 +1,405 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	_ "time/tzdata" // time zones on Windows without Go installation
 )
 
 const (
 	WIN_EXT  = ".exe"
 	JSON_EXT = ".json"
+
+	CMD_EXPORT      = "export"
+	CMD_BACKFILL    = "backfill"
+	CMD_OUTBOX      = "outbox"
+	CMD_DEAD_LETTER = "deadletter"
+
+	OUTBOX_LIST  = "list"
+	OUTBOX_RETRY = "retry"
+	OUTBOX_PURGE = "purge"
 )
 
 func main() {
-	//Configuration file: first argument or PROG_FILE_NAME.json
-	var ini_file string
 	if len(os.Args) >= 2 {
-		ini_file = os.Args[1]
-	} else {
-		if runtime.GOOS == "windows" && strings.HasSuffix(strings.ToLower(os.Args[0]), WIN_EXT) {
-			ini_file, _ = strings.CutSuffix(strings.ToLower(os.Args[0]), WIN_EXT)
-		} else {
-			ini_file = os.Args[0]
+		switch os.Args[1] {
+		case CMD_EXPORT:
+			runExport(os.Args[2:])
+			return
+		case CMD_BACKFILL:
+			runBackfill(os.Args[2:])
+			return
+		case CMD_OUTBOX:
+			runOutbox(os.Args[2:])
+			return
+		case CMD_DEAD_LETTER:
+			runDeadLetter(os.Args[2:])
+			return
 		}
-		ini_file += JSON_EXT
 	}
+	runService(os.Args[1:])
+}
 
+// configFileName returns configuration file: first argument or PROG_FILE_NAME.json
+func configFileName(args []string) string {
+	if len(args) >= 1 {
+		return args[0]
+	}
+	var ini_file string
+	if runtime.GOOS == "windows" && strings.HasSuffix(strings.ToLower(os.Args[0]), WIN_EXT) {
+		ini_file, _ = strings.CutSuffix(strings.ToLower(os.Args[0]), WIN_EXT)
+	} else {
+		ini_file = os.Args[0]
+	}
+	return ini_file + JSON_EXT
+}
+
+func loadApp(iniFile string) *App {
 	app := NewApp()
-	conf_data, err := os.ReadFile(ini_file)
+	conf_data, err := os.ReadFile(iniFile)
 	if err != nil {
 		panic(fmt.Sprintf("os.ReadFile() failed: %v", err))
 	}
 	if err := app.LoadConfig(conf_data); err != nil {
 		panic(fmt.Sprintf("app.LoadConfig() failed: %v", err))
 	}
-	if err := app.Start(); err != nil {
+	return app
+}
+
+// signalContext returns context which is cancelled on SIGINT or SIGTERM.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+func openCheckpoints(app *App, iniFile string) {
+	if app.Config.CheckpointFile == "" {
+		app.Config.CheckpointFile = CheckpointFileName(iniFile)
+	}
+	if err := app.OpenCheckpoints(app.Config.CheckpointFile); err != nil {
+		panic(fmt.Sprintf("app.OpenCheckpoints() failed: %v", err))
+	}
+}
+
+func openOutbox(app *App, iniFile string) {
+	if app.Config.Outbox.Dir == "" {
+		app.Config.Outbox.Dir = OutboxDirName(iniFile)
+	}
+	if err := app.OpenOutbox(app.Config.Outbox.Dir); err != nil {
+		panic(fmt.Sprintf("app.OpenOutbox() failed: %v", err))
+	}
+}
+
+func setDeadLetterFile(app *App, iniFile string) {
+	if app.Config.DeadLetterFile == "" {
+		app.Config.DeadLetterFile = DeadLetterFileName(iniFile)
+	}
+}
+
+// openState opens delivery state: checkpoints, outbox and dead-letter file.
+// Every destination has its own state files named after CONFIG_NAME.DESTINATION.
+func openState(app *App, iniFile string) {
+	if len(app.destinations) == 0 {
+		openCheckpoints(app, iniFile)
+		openOutbox(app, iniFile)
+		setDeadLetterFile(app, iniFile)
+		return
+	}
+	for _, d := range app.destinations {
+		dest_file := DestinationConfigFile(iniFile, d.name)
+		openCheckpoints(d.App, dest_file)
+		openOutbox(d.App, dest_file)
+		setDeadLetterFile(d.App, dest_file)
+	}
+}
+
+// runService starts main export loop.
+// Usage: rkexport [-reset-checkpoint] [-rewind-checkpoint DATE] [CONFIG]
+func runService(args []string) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	reset_checkpoint := flags.Bool("reset-checkpoint", false, "remove all checkpoints, period is taken from API on the next run")
+	rewind_checkpoint := flags.String("rewind-checkpoint", "", "rewind checkpoints to date in format "+ReportPeriodLoyout)
+	flags.Parse(args)
+
+	ini_file := configFileName(flags.Args())
+	app := loadApp(ini_file)
+	openState(app, ini_file)
+
+	//checkpoints of all destinations are changed
+	if *reset_checkpoint {
+		for _, t := range app.targets() {
+			t.checkpoints.Reset()
+			if err := t.checkpoints.Save(); err != nil {
+				panic(fmt.Sprintf("checkpoints.Save() failed: %v", err))
+			}
+		}
+		app.Log.Infof("checkpoints reset")
+	}
+	if *rewind_checkpoint != "" {
+		rewind_dt, err := time.ParseInLocation(ReportPeriodLoyout, *rewind_checkpoint, app.location)
+		if err != nil {
+			panic(fmt.Sprintf("time.Parse() failed: %v", err))
+		}
+		for _, t := range app.targets() {
+			t.checkpoints.Rewind(rewind_dt)
+			if err := t.checkpoints.Save(); err != nil {
+				panic(fmt.Sprintf("checkpoints.Save() failed: %v", err))
+			}
+		}
+		app.Log.Infof("checkpoints rewound to %s", *rewind_checkpoint)
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	if err := app.Start(ctx); err != nil {
 		app.Log.Errorf("app.Start() failed: %v", err)
 		os.Exit(1)
 	}
 }
+
+// runExport writes data for the period to file or stdout without contacting API.
+// Usage: rkexport export -from DATE -to DATE [-out FILE] [CONFIG]
+func runExport(args []string) {
+	flags := flag.NewFlagSet(CMD_EXPORT, flag.ExitOnError)
+	date_from := flags.String("from", "", "period start in format "+ReportPeriodLoyout+" or "+EXPORT_DATE_TIME_LAYOUT)
+	date_to := flags.String("to", "", "period end in format "+ReportPeriodLoyout+" (whole day) or "+EXPORT_DATE_TIME_LAYOUT)
+	out_file := flags.String("out", "", "output file, stdout if not set")
+	flags.Parse(args)
+
+	if *date_from == "" || *date_to == "" {
+		fmt.Fprintln(os.Stderr, "-from and -to are required")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	app := loadApp(configFileName(flags.Args()))
+	if *out_file == "" && (app.Config.LogTo == "" || app.Config.LogTo == "stdout") {
+		//keep stdout for data
+		app.Log.SetOutput(os.Stderr)
+	}
+
+	dt_from, dt_to, err := app.ParseExportPeriod(*date_from, *date_to)
+	if err != nil {
+		app.Log.Errorf("ParseExportPeriod() failed: %v", err)
+		os.Exit(2)
+	}
+
+	out := os.Stdout
+	if *out_file != "" {
+		if out, err = os.Create(*out_file); err != nil {
+			app.Log.Errorf("os.Create() failed: %v", err)
+			os.Exit(1)
+		}
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	cnt, err := app.Export(ctx, dt_from, dt_to, out)
+	if *out_file != "" {
+		if close_err := out.Close(); err == nil && close_err != nil {
+			err = fmt.Errorf("file.Close() failed: %v", close_err)
+		}
+	}
+	if err != nil {
+		app.Log.Errorf("app.Export() failed: %v", err)
+		os.Exit(1)
+	}
+	app.Log.Infof("exported %d records for period %s - %s", cnt, dt_from.Format(PARAM_DATE_LAYOUT), dt_to.Format(PARAM_DATE_LAYOUT))
+}
+
+// runBackfill sends data for the range to API day by day.
+// Usage: rkexport backfill -from DATE -to DATE [-restart] [CONFIG]
+func runBackfill(args []string) {
+	flags := flag.NewFlagSet(CMD_BACKFILL, flag.ExitOnError)
+	date_from := flags.String("from", "", "first day in format "+ReportPeriodLoyout)
+	date_to := flags.String("to", "", "last day in format "+ReportPeriodLoyout)
+	restart := flags.Bool("restart", false, "start from the first day even if an interrupted backfill of the same range exists")
+	flags.Parse(args)
+
+	if *date_from == "" || *date_to == "" {
+		fmt.Fprintln(os.Stderr, "-from and -to are required")
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	ini_file := configFileName(flags.Args())
+	app := loadApp(ini_file)
+	openState(app, ini_file)
+
+	dt_from, dt_to, err := app.ParseExportPeriod(*date_from, *date_to)
+	if err != nil {
+		app.Log.Errorf("ParseExportPeriod() failed: %v", err)
+		os.Exit(2)
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	if err := app.Backfill(ctx, dt_from, dt_to, BackfillFileName(ini_file), *restart); err != nil {
+		app.Log.Errorf("app.Backfill() failed: %v", err)
+		os.Exit(1)
+	}
+}
+
+// commandTargets returns the apps a state command is run for with their destination names:
+// the app itself or its destinations, dest selects one of them.
+func commandTargets(app *App, dest string) ([]string, []*App) {
+	if len(app.destinations) == 0 {
+		return []string{""}, []*App{app}
+	}
+	var names []string
+	var targets []*App
+	for _, d := range app.destinations {
+		if dest == "" || dest == d.name {
+			names = append(names, d.name)
+			targets = append(targets, d.App)
+		}
+	}
+	if len(targets) == 0 {
+		fmt.Fprintf(os.Stderr, "destination %s not found\n", dest)
+		os.Exit(2)
+	}
+	return names, targets
+}
+
+// runOutbox lists, replays or removes undelivered batches of the outbox.
+// With destinations every destination has its own outbox, -dest selects one of them.
+// Usage: rkexport outbox list|retry|purge [-dest NAME] [-id ID] [-all] [CONFIG]
+func runOutbox(args []string) {
+	if len(args) < 1 || (args[0] != OUTBOX_LIST && args[0] != OUTBOX_RETRY && args[0] != OUTBOX_PURGE) {
+		fmt.Fprintln(os.Stderr, "usage: outbox list|retry|purge [-dest NAME] [-id ID] [-all] [CONFIG]")
+		os.Exit(2)
+	}
+	cmd := args[0]
+	flags := flag.NewFlagSet(CMD_OUTBOX+" "+cmd, flag.ExitOnError)
+	dest := flags.String("dest", "", "destination name, all destinations if not set")
+	id := flags.String("id", "", "batch id, all batches if not set")
+	all := flags.Bool("all", false, "purge all batches")
+	flags.Parse(args[1:])
+
+	ini_file := configFileName(flags.Args())
+	app := loadApp(ini_file)
+	openState(app, ini_file)
+
+	names, targets := commandTargets(app, *dest)
+	if *id != "" && len(targets) > 1 {
+		fmt.Fprintln(os.Stderr, "-dest is required with -id")
+		os.Exit(2)
+	}
+
+	switch cmd {
+	case OUTBOX_LIST:
+		if app.Config.LogTo == "" || app.Config.LogTo == "stdout" {
+			//keep stdout for the list
+			app.Log.SetOutput(os.Stderr)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DESTINATION\tID\tCREATED\tROWS\tATTEMPTS\tLAST ERROR")
+		for i, t := range targets {
+			list, err := t.outbox.List()
+			if err != nil {
+				app.Log.Errorf("outbox.List() failed: %v", err)
+				os.Exit(1)
+			}
+			for _, b := range list {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", names[i], b.ID, b.Created.Format(time.RFC3339), b.Rows, b.Attempts, b.LastError)
+			}
+		}
+		w.Flush()
+
+	case OUTBOX_RETRY:
+		ctx, stop := signalContext()
+		defer stop()
+		sent, failed := 0, 0
+		for _, t := range targets {
+			t_sent, t_failed, err := t.RetryOutbox(ctx, *id)
+			if err != nil {
+				app.Log.Errorf("app.RetryOutbox() failed: %v", err)
+				os.Exit(1)
+			}
+			sent, failed = sent+t_sent, failed+t_failed
+		}
+		app.Log.Infof("outbox retry: %d delivered, %d failed", sent, failed)
+		if failed > 0 {
+			os.Exit(1)
+		}
+
+	case OUTBOX_PURGE:
+		if *id == "" && !*all {
+			fmt.Fprintln(os.Stderr, "-id or -all is required")
+			flags.Usage()
+			os.Exit(2)
+		}
+		cnt := 0
+		for _, t := range targets {
+			t_cnt, err := t.PurgeOutbox(*id)
+			if err != nil {
+				app.Log.Errorf("app.PurgeOutbox() failed: %v", err)
+				os.Exit(1)
+			}
+			cnt += t_cnt
+		}
+		app.Log.Infof("outbox purge: %d batches removed", cnt)
+	}
+}
+
+// runDeadLetter lists the checks of the dead-letter file or sends them again,
+// delivered checks are removed from the file.
+// With destinations every destination has its own file, -dest selects one of them.
+// Usage: rkexport deadletter list|retry [-dest NAME] [CONFIG]
+func runDeadLetter(args []string) {
+	if len(args) < 1 || (args[0] != OUTBOX_LIST && args[0] != OUTBOX_RETRY) {
+		fmt.Fprintln(os.Stderr, "usage: deadletter list|retry [-dest NAME] [CONFIG]")
+		os.Exit(2)
+	}
+	cmd := args[0]
+	flags := flag.NewFlagSet(CMD_DEAD_LETTER+" "+cmd, flag.ExitOnError)
+	dest := flags.String("dest", "", "destination name, all destinations if not set")
+	flags.Parse(args[1:])
+
+	ini_file := configFileName(flags.Args())
+	app := loadApp(ini_file)
+	openState(app, ini_file)
+	names, targets := commandTargets(app, *dest)
+
+	switch cmd {
+	case OUTBOX_LIST:
+		if app.Config.LogTo == "" || app.Config.LogTo == "stdout" {
+			//keep stdout for the list
+			app.Log.SetOutput(os.Stderr)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DESTINATION\tTIME\tCHECK\tROWS\tSTATUS\tERROR")
+		for i, t := range targets {
+			list, err := t.ReadDeadLetters()
+			if err != nil {
+				app.Log.Errorf("app.ReadDeadLetters() failed: %v", err)
+				os.Exit(1)
+			}
+			for _, e := range list {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", names[i], e.Time.Format(time.RFC3339), e.CheckId, len(e.Rows), e.StatusCode, e.Error)
+			}
+		}
+		w.Flush()
+
+	case OUTBOX_RETRY:
+		ctx, stop := signalContext()
+		defer stop()
+		sent, failed := 0, 0
+		for _, t := range targets {
+			t_sent, t_failed, err := t.RetryDeadLetters(ctx)
+			if err != nil {
+				app.Log.Errorf("app.RetryDeadLetters() failed: %v", err)
+				os.Exit(1)
+			}
+			sent, failed = sent+t_sent, failed+t_failed
+		}
+		app.Log.Infof("dead-letter retry: %d delivered, %d failed", sent, failed)
+		if failed > 0 {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCHEDULE_MAX_DAYS limits the search of the next cron activation.
+const SCHEDULE_MAX_DAYS = 366 * 5
+
+// Schedule is a set of activation rules: times of day, an interval and a cron expression.
+// The next activation is the earliest one of all rules.
+type Schedule struct {
+	times    []int // minutes from midnight, sorted
+	interval int   // minutes, counted from midnight
+	cron     *cronExpr
+}
+
+// ParseSchedule validates activation rules, any of them can be empty.
+func ParseSchedule(times []string, interval int, cron string) (*Schedule, error) {
+	s := &Schedule{}
+	for _, tm := range times {
+		act_time, err := time.Parse(CONF_TIME_LAYOUT, strings.TrimSpace(tm))
+		if err != nil {
+			return nil, fmt.Errorf("invalid activation time %q: %v", tm, err)
+		}
+		s.times = append(s.times, act_time.Hour()*60+act_time.Minute())
+	}
+	sort.Ints(s.times)
+
+	if interval < 0 {
+		return nil, fmt.Errorf("invalid activation interval: %d", interval)
+	}
+	s.interval = interval
+
+	if cron != "" {
+		expr, err := parseCron(cron)
+		if err != nil {
+			return nil, fmt.Errorf("invalid activation cron %q: %v", cron, err)
+		}
+		s.cron = expr
+	}
+	return s, nil
+}
+
+// Empty returns true if no rule is set.
+func (s *Schedule) Empty() bool {
+	return len(s.times) == 0 && s.interval == 0 && s.cron == nil
+}
+
+// Next returns the first activation strictly after now in the location of now.
+// Activations are whole minutes.
+func (s *Schedule) Next(now time.Time) (time.Time, error) {
+	if s.Empty() {
+		return time.Time{}, fmt.Errorf("activation schedule is not set")
+	}
+	var next time.Time
+	earliest := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if len(s.times) > 0 {
+		earliest(nextDayMinute(now, midnight, s.times))
+	}
+	if s.interval > 0 {
+		var minutes []int
+		for m := 0; m < 24*60; m += s.interval {
+			minutes = append(minutes, m)
+		}
+		earliest(nextDayMinute(now, midnight, minutes))
+	}
+	if s.cron != nil {
+		cron_dt, err := s.cron.next(now, midnight)
+		if err != nil {
+			return time.Time{}, err
+		}
+		earliest(cron_dt)
+	}
+	return next, nil
+}
+
+// nextDayMinute returns the first of sorted minutes after now, today or tomorrow.
+func nextDayMinute(now, midnight time.Time, minutes []int) time.Time {
+	for _, m := range minutes {
+		dt := time.Date(midnight.Year(), midnight.Month(), midnight.Day(), m/60, m%60, 0, 0, now.Location())
+		if dt.After(now) {
+			return dt
+		}
+	}
+	m := minutes[0]
+	return time.Date(midnight.Year(), midnight.Month(), midnight.Day()+1, m/60, m%60, 0, 0, now.Location())
+}
+
+// cronExpr is a standard 5 field cron expression: minute hour day-of-month month day-of-week.
+// Fields support *, numbers, ranges a-b, steps */n and a-b/n and lists.
+// Day of week is 0-7, both 0 and 7 are Sunday. If both day fields are restricted,
+// a day matches either of them.
+type cronExpr struct {
+	minutes  []bool
+	hours    []bool
+	days     []bool
+	months   []bool
+	weekdays []bool
+	anyDay   bool // day-of-month is *
+	anyWeek  bool // day-of-week is *
+}
+
+func parseCron(expr string) (*cronExpr, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("5 fields expected, got %d", len(fields))
+	}
+	c := &cronExpr{
+		anyDay:  fields[2] == "*",
+		anyWeek: fields[4] == "*",
+	}
+	var err error
+	if c.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if c.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if c.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if c.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if c.weekdays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if c.weekdays[7] {
+		c.weekdays[0] = true
+	}
+	return c, nil
+}
+
+// parseCronField returns flags indexed by value for min..max.
+func parseCronField(field string, min, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		rng, step_s, has_step := strings.Cut(part, "/")
+		step := 1
+		if has_step {
+			var err error
+			if step, err = strconv.Atoi(step_s); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step %q", step_s)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			lo_s, hi_s, is_range := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(lo_s); err != nil {
+				return nil, fmt.Errorf("invalid value %q", lo_s)
+			}
+			hi = lo
+			if is_range {
+				if hi, err = strconv.Atoi(hi_s); err != nil {
+					return nil, fmt.Errorf("invalid value %q", hi_s)
+				}
+			} else if has_step {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronExpr) dayMatches(day time.Time) bool {
+	if !c.months[day.Month()] {
+		return false
+	}
+	dom := c.days[day.Day()]
+	dow := c.weekdays[day.Weekday()]
+	switch {
+	case c.anyDay && c.anyWeek:
+		return true
+	case c.anyDay:
+		return dow
+	case c.anyWeek:
+		return dom
+	}
+	return dom || dow
+}
+
+func (c *cronExpr) next(now, midnight time.Time) (time.Time, error) {
+	for d := 0; d < SCHEDULE_MAX_DAYS; d++ {
+		day := time.Date(midnight.Year(), midnight.Month(), midnight.Day()+d, 0, 0, 0, 0, now.Location())
+		if !c.dayMatches(day) {
+			continue
+		}
+		for h := 0; h < 24; h++ {
+			if !c.hours[h] {
+				continue
+			}
+			for m := 0; m < 60; m++ {
+				if !c.minutes[m] {
+					continue
+				}
+				dt := time.Date(day.Year(), day.Month(), day.Day(), h, m, 0, 0, now.Location())
+				if dt.After(now) {
+					return dt, nil
+				}
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("cron expression never fires")
+}
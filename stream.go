@@ -0,0 +1,295 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Streaming export defaults.
+const (
+	STREAM_MAX_ROWS  = 10000
+	STREAM_MAX_BYTES = 5 * 1024 * 1024
+)
+
+// streamPos is the position of the next streaming request in the period.
+type streamPos struct {
+	from  int      // rows handled in offset mode
+	after CheckKey // the last handled row in keyset mode
+}
+
+// streamPeriod sends data for the period with streaming requests: rows are encoded
+// to the request body (chunked transfer) as they are read from MS server,
+// only the rows of the current check are kept in memory. A request is finished
+// after Stream.MaxRows rows or Stream.MaxBytes bytes, a check is never split between requests.
+// A failed request is retried by the retry policy, its rows are read again.
+// If skipDelivered is set, checks delivered before are not sent.
+// It returns the number of rows sent.
+func (a *App) streamPeriod(ctx context.Context, dateFrom, dateTo time.Time, url string, skipDelivered bool) (int, error) {
+	a.batchPeriod = [2]time.Time{dateFrom, dateTo}
+	pos := streamPos{}
+	total := 0
+	count := defInt(a.Config.Stream.MaxRows, STREAM_MAX_ROWS)
+	for {
+		var b *streamBatch
+		if err := a.retry(ctx, "streamBatch()", func() error {
+			b = &streamBatch{
+				a:             a,
+				ctx:           ctx,
+				url:           url,
+				skipDelivered: skipDelivered,
+				maxBytes:      defInt(a.Config.Stream.MaxBytes, STREAM_MAX_BYTES),
+				groups:        make(map[string]CheckKey),
+			}
+			return b.send(pos, count, dateFrom, dateTo)
+		}); err != nil {
+			return total, err
+		}
+		if b.grow {
+			//a check with more rows than the request, read it again to the end
+			count *= 2
+			a.Log.Debugf("request of %d records holds one check, reading %d records", b.read, count)
+			continue
+		}
+		if b.rows > 0 {
+			a.Log.Debugf("streamed records: %d, bytes: %d", b.rows, b.bytes.n)
+			group_keys := make([]CheckKey, 0, len(b.groups))
+			for _, key := range b.groups {
+				group_keys = append(group_keys, key)
+			}
+			if err := a.commitCheckpoints(group_keys); err != nil {
+				return total, fmt.Errorf("commitCheckpoints() failed: %v", err)
+			}
+			total += b.rows
+		}
+		if err := a.rejectRows(b.rejected, b.rejectedKeys); err != nil {
+			return total, err
+		}
+		if b.done {
+			return total, nil
+		}
+		pos = streamPos{from: pos.from + b.handled, after: b.last}
+	}
+}
+
+// streamBatch is one streaming request.
+type streamBatch struct {
+	a             *App
+	ctx           context.Context
+	url           string
+	skipDelivered bool
+	maxBytes      int
+
+	//request, started with the first row to send
+	pw      *io.PipeWriter
+	zw      *gzip.Writer
+	bytes   countWriter
+	hash    hash.Hash
+	trailer http.Header
+	resp    chan error
+	cancel  context.CancelFunc
+
+	held         []RKRow // rows of the current check
+	heldKeys     []CheckKey
+	rejected     []RKRow // rows rejected by QueryRows(), passed to rejectRows() after the request
+	rejectedKeys []CheckKey
+	read         int      // rows read from MS server
+	handled      int      // rows sent or skipped
+	last         CheckKey // the last handled row
+	rows         int      // rows sent
+	groups       map[string]CheckKey
+	stopped      bool // MaxBytes reached
+	grow         bool // the rows read are one check, it may have more rows
+	done         bool // no more rows in the period
+}
+
+// countWriter counts bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+// sameCheck returns true for rows of the same check.
+// Every row without key is a check of its own.
+func sameCheck(k1, k2 CheckKey) bool {
+	return !k1.IsZero() && k1.Restaurant == k2.Restaurant && k1.Compare(k2) == 0
+}
+
+func (b *streamBatch) send(pos streamPos, count int, dateFrom, dateTo time.Time) error {
+	err := b.a.queryRows(b.ctx, pos.from, count, pos.after, dateFrom, dateTo, b.row)
+	if err == nil && !b.stopped && len(b.held) > 0 {
+		//the last check may continue on the next page unless the period is over,
+		//a check filling the whole page is read again with a larger count
+		if b.read < count || b.heldKeys[0].IsZero() {
+			err = b.flush()
+		} else if b.handled == 0 {
+			b.grow = true
+			return nil
+		}
+	}
+	b.done = err == nil && !b.stopped && b.read < count
+	if b.pw == nil {
+		if err != nil {
+			return permanent(fmt.Errorf("QueryRows() failed: %v", err))
+		}
+		return nil //nothing to send
+	}
+	defer b.cancel()
+	if err != nil {
+		b.pw.CloseWithError(err)
+		if resp_err := <-b.resp; resp_err != nil {
+			return resp_err
+		}
+		return permanent(fmt.Errorf("QueryRows() failed: %v", err))
+	}
+	return b.finish()
+}
+
+// row is QueryRows() callback.
+func (b *streamBatch) row(row RKRow, key CheckKey) error {
+	b.read++
+	if len(b.held) > 0 && !sameCheck(key, b.heldKeys[0]) {
+		if err := b.flush(); err != nil {
+			return err
+		}
+		if b.bytes.n >= b.maxBytes {
+			b.stopped = true
+			return errStopRows
+		}
+	}
+	if b.skipDelivered && b.a.checkpoints != nil && b.a.checkpoints.Delivered(key) {
+		b.handled++
+		b.last = key
+		return nil
+	}
+	b.held = append(b.held, row)
+	b.heldKeys = append(b.heldKeys, key)
+	return nil
+}
+
+// flush writes the rows of the current check to request body,
+// the request is started with the first row to send. Rejected rows are not written.
+func (b *streamBatch) flush() error {
+	for i, row := range b.held {
+		key := b.heldKeys[i]
+		if _, ok := row.(*rejectedRow); ok {
+			b.rejected = append(b.rejected, row)
+			b.rejectedKeys = append(b.rejectedKeys, key)
+			continue
+		}
+		if b.pw == nil {
+			if err := b.start(); err != nil {
+				return err
+			}
+		}
+		row_b, err := json.Marshal(row)
+		if err != nil {
+			return fmt.Errorf("json.Marshal() failed: %v", err)
+		}
+		if b.rows > 0 {
+			row_b = append([]byte(","), row_b...)
+		}
+		if _, err := b.bytes.Write(row_b); err != nil {
+			return err
+		}
+		if key.IsZero() {
+			b.hash.Write(row_b)
+		} else {
+			hashBatchKey(b.hash, key)
+		}
+		if last, ok := b.groups[key.GroupID()]; !ok || key.Compare(last) > 0 {
+			b.groups[key.GroupID()] = key
+		}
+		b.rows++
+	}
+	b.handled += len(b.held)
+	b.last = b.heldKeys[len(b.heldKeys)-1]
+	b.held, b.heldKeys = b.held[:0], b.heldKeys[:0]
+	return nil
+}
+
+// start sends request headers, the body is written by flush().
+// Idempotency key is known at the end only, it is sent in the trailer
+// and at the end of the envelope.
+func (b *streamBatch) start() error {
+	a := b.a
+	pr, pw := io.Pipe()
+	req_ctx, cancel := requestContext(b.ctx)
+	req, err := http.NewRequestWithContext(req_ctx, "POST", b.url, pr)
+	if err != nil {
+		cancel()
+		return permanent(fmt.Errorf("http.NewRequest() failed: %v", err))
+	}
+	b.pw = pw
+	b.cancel = cancel
+	b.bytes.w = pw
+	if a.Config.HTTPClient.Gzip {
+		b.zw = gzip.NewWriter(pw)
+		b.bytes.w = b.zw
+	}
+	b.hash = a.newBatchHash()
+
+	req.Header.Set("Content-Type", "application/json")
+	if a.Config.HTTPClient.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set(API_TOKEN_HEADER_ID, a.Config.APIKey)
+	b.trailer = http.Header{IDEMPOTENCY_HEADER: nil}
+	req.Trailer = b.trailer
+
+	b.resp = make(chan error, 1)
+	go func() {
+		resp, err := a.httpClient.Do(req)
+		if err != nil {
+			pr.CloseWithError(err)
+			b.resp <- fmt.Errorf("client.Do() failed: %v", err)
+			return
+		}
+		defer drainClose(resp.Body)
+		pr.Close() //the response may come before the whole body is read
+		if resp.StatusCode != http.StatusOK {
+			b.resp <- newAPIError(resp)
+			return
+		}
+		b.resp <- nil
+	}()
+
+	env := a.dataEnvelope(nil)
+	head, err := json.Marshal(struct {
+		Schema        string `json:"schema"`
+		SchemaVersion int    `json:"schema_version,omitempty"`
+	}{env.Schema, env.SchemaVersion})
+	if err != nil {
+		return fmt.Errorf("json.Marshal() failed: %v", err)
+	}
+	head = append(head[:len(head)-1], []byte(`,"data":[`)...)
+	_, err = b.bytes.Write(head)
+	return err
+}
+
+// finish writes the end of the envelope and waits for the response.
+func (b *streamBatch) finish() error {
+	batch_key := hex.EncodeToString(b.hash.Sum(nil))
+	b.trailer.Set(IDEMPOTENCY_HEADER, batch_key)
+	_, err := b.bytes.Write([]byte(`],"idempotency_key":"` + batch_key + `"}`))
+	if err == nil && b.zw != nil {
+		err = b.zw.Close()
+	}
+	b.pw.CloseWithError(err)
+	if resp_err := <-b.resp; resp_err != nil {
+		return resp_err
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// API url placeholders.
+const (
+	URL_PH_SC_ID            = "{{scID}}"
+	URL_PH_SALE_LOCATION_ID = "{{saleLocationID}}"
+	URL_PH_DATE_FROM        = "{{dateFrom}}" // export period, send data url only
+	URL_PH_DATE_TO          = "{{dateTo}}"
+	URL_PH_ENV_PREFIX       = "{{env:" // {{env:NAME}} - environment variable NAME
+)
+
+var (
+	urlPlaceholderRe = regexp.MustCompile(`{{[^{}]*}}`)
+	urlEnvRe         = regexp.MustCompile(`^{{env:[A-Za-z_][A-Za-z0-9_]*}}$`)
+)
+
+// ValidateURLTemplate checks that there are no unknown or unclosed placeholders
+// in the url template. Period placeholders are allowed if dates is set.
+func ValidateURLTemplate(text string, dates bool) error {
+	known := map[string]bool{URL_PH_SC_ID: true, URL_PH_SALE_LOCATION_ID: true}
+	if dates {
+		known[URL_PH_DATE_FROM] = true
+		known[URL_PH_DATE_TO] = true
+	}
+
+	var unknown []string
+	for _, ph := range urlPlaceholderRe.FindAllString(text, -1) {
+		if !known[ph] && !urlEnvRe.MatchString(ph) {
+			unknown = append(unknown, ph)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown placeholders: %s", strings.Join(unknown, ", "))
+	}
+	if rest := urlPlaceholderRe.ReplaceAllString(text, ""); strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+		return fmt.Errorf("unclosed placeholder: %s", text)
+	}
+	return nil
+}
+
+// validateURLs checks the placeholders of API url and commands.
+// Period placeholders are allowed in apiCmdPutData only.
+func (c *AppConfig) validateURLs() error {
+	for _, t := range []struct {
+		name  string
+		text  string
+		dates bool
+	}{
+		{"apiUrl", c.APIUrl, false},
+		{"apiCmdGetPeriod", c.APICmdGetPeriod, false},
+		{"apiCmdPutData", c.APICmdPutData, true},
+	} {
+		if err := ValidateURLTemplate(t.text, t.dates); err != nil {
+			return fmt.Errorf("%s: %v", t.name, err)
+		}
+	}
+	return nil
+}
+
+// joinURL appends the command path to API url, query parameters of both are kept:
+// http://host/api?key=1 + create_order?dt=2 = http://host/api/create_order/?key=1&dt=2
+func joinURL(apiURL, cmd string) string {
+	api_path, api_query, _ := strings.Cut(apiURL, "?")
+	cmd_path, cmd_query, _ := strings.Cut(cmd, "?")
+	res := ensureSlash(api_path)
+	if cmd_path != "" {
+		res += ensureSlash(cmd_path)
+	}
+	var query []string
+	for _, q := range []string{api_query, cmd_query} {
+		if q != "" {
+			query = append(query, q)
+		}
+	}
+	if len(query) > 0 {
+		res += "?" + strings.Join(query, "&")
+	}
+	return res
+}
+
+// expandURL replaces placeholders with values and environment variables.
+// Values are escaped for the part of the url they are in: path or query,
+// environment variables are inserted as is, they may hold a part of the url.
+// Placeholders missing in values are left as is.
+func expandURL(text string, values map[string]string) (string, error) {
+	query_pos := strings.Index(text, "?")
+	var res strings.Builder
+	last := 0
+	for _, m := range urlPlaceholderRe.FindAllStringIndex(text, -1) {
+		ph := text[m[0]:m[1]]
+		if strings.HasPrefix(ph, URL_PH_ENV_PREFIX) {
+			name := strings.TrimSuffix(strings.TrimPrefix(ph, URL_PH_ENV_PREFIX), "}}")
+			val, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			res.WriteString(text[last:m[0]])
+			res.WriteString(val)
+			last = m[1]
+			continue
+		}
+		val, ok := values[ph]
+		if !ok {
+			continue
+		}
+		res.WriteString(text[last:m[0]])
+		if query_pos >= 0 && m[0] > query_pos {
+			res.WriteString(url.QueryEscape(val))
+		} else {
+			res.WriteString(url.PathEscape(val))
+		}
+		last = m[1]
+	}
+	res.WriteString(text[last:])
+	return res.String(), nil
+}
+
+// checkAbsURL returns an error if the expanded url is not an absolute http(s) url.
+func checkAbsURL(text string) error {
+	u, err := url.Parse(text)
+	if err != nil {
+		return fmt.Errorf("url.Parse() failed: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("API url %s is not an absolute http(s) url", text)
+	}
+	return nil
+}
+
+// periodURL replaces period placeholders of send data url with the dates of the period.
+func periodURL(text string, dateFrom, dateTo time.Time) (string, error) {
+	return expandURL(text, map[string]string{
+		URL_PH_DATE_FROM: dateFrom.Format(ReportPeriodLoyout),
+		URL_PH_DATE_TO:   dateTo.Format(ReportPeriodLoyout),
+	})
+}